@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// AuditEvent records who requested what access, and why it was (or wasn't) granted.
+// Events never include the issued token.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Handler string    `json:"handler"`
+	Status  int       `json:"status"`
+
+	Issuer  string `json:"iss,omitempty"`
+	Subject string `json:"sub,omitempty"`
+	Claims  Claims `json:"claims,omitempty"`
+
+	Repositories []string          `json:"repositories,omitempty"`
+	Permissions  map[string]string `json:"permissions,omitempty"`
+
+	Allowed bool     `json:"allowed"`
+	Reasons []string `json:"reasons,omitempty"`
+	// Granted is the access of the issued token, or the narrower access the policies would grant if none was issued.
+	Granted   *TokenRequest    `json:"granted,omitempty"`
+	Policies  []PolicyDecision `json:"policies,omitempty"`
+	ExpiresAt *time.Time       `json:"expires_at,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// AuditSink records AuditEvents.
+type AuditSink interface {
+	Audit(ctx context.Context, event *AuditEvent) error
+}
+
+// audit records the outcome of the request to the AuditSink, if one is configured.
+func (h *Handler) audit(ctx context.Context, handler string, status int, authz *authorization, tok *IssuedToken, err error) {
+	if h.auditSink == nil {
+		return
+	}
+
+	event := AuditEvent{
+		Time:    time.Now().UTC(),
+		Handler: handler,
+		Status:  status,
+		Claims:  authz.claims,
+	}
+	if authz.claims != nil {
+		event.Issuer, _ = authz.claims["iss"].(string)
+		event.Subject, _ = authz.claims["sub"].(string)
+	}
+	if authz.req != nil {
+		event.Repositories = authz.req.Repositories
+		event.Permissions = authz.req.Permissions
+	}
+	if authz.decision != nil {
+		event.Allowed = authz.decision.Allowed
+		event.Reasons = authz.decision.Reasons
+		event.Granted = authz.decision.Granted
+		event.Policies = authz.decision.Policies
+	}
+	if tok != nil {
+		event.Granted = &TokenRequest{Repositories: tok.Repositories, Permissions: tok.Permissions}
+		event.ExpiresAt = &tok.ExpiresAt
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if err := h.auditSink.Audit(ctx, &event); err != nil {
+		h.log.Error("error writing audit event", slog.String("err", err.Error()))
+	}
+}
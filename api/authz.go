@@ -46,7 +46,80 @@ func (r TokenRequest) OwnerPermissions() bool {
 	return false
 }
 
+// permissionLevels ranks the access levels of permissions.
+var permissionLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// Intersect returns the access in this request that is also in grant, at the lower of the two levels.
+// If grant doesn't list repositories, the requested repositories are kept.
+func (r TokenRequest) Intersect(grant TokenRequest) TokenRequest {
+	res := TokenRequest{
+		Permissions: make(map[string]string, len(r.Permissions)),
+	}
+	for perm, level := range r.Permissions {
+		granted, ok := grant.Permissions[perm]
+		if !ok {
+			continue
+		}
+		if granted == level {
+			res.Permissions[perm] = level
+			continue
+		}
+		requestedRank, grantedRank := permissionLevels[level], permissionLevels[granted]
+		if requestedRank == 0 || grantedRank == 0 {
+			// Unknown levels can't be compared, so only an exact match is granted
+			continue
+		}
+		if grantedRank < requestedRank {
+			res.Permissions[perm] = granted
+		} else {
+			res.Permissions[perm] = level
+		}
+	}
+
+	if len(grant.Repositories) == 0 {
+		res.Repositories = r.Repositories
+		return res
+	}
+	for _, repo := range r.Repositories {
+		for _, granted := range grant.Repositories {
+			if strings.EqualFold(repo, granted) {
+				res.Repositories = append(res.Repositories, repo)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Decision is the outcome of a TokenChecker, with the policies that were consulted to reach it.
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Reasons the request was denied, if the policies gave any.
+	Reasons []string `json:"reasons,omitempty"`
+	// Granted is the access to issue if it is narrower than requested, nil if the request is allowed as-is.
+	Granted  *TokenRequest    `json:"granted,omitempty"`
+	Policies []PolicyDecision `json:"policies"`
+}
+
+// PolicyDecision is the outcome of a single policy.
+type PolicyDecision struct {
+	// Repository the policy was loaded from, if any.
+	Repository string `json:"repository,omitempty"`
+	// SHA of the policy that was loaded, if any.
+	SHA string `json:"sha,omitempty"`
+	// Owner is set if this was the authoritative owner policy.
+	Owner   bool     `json:"owner,omitempty"`
+	Allowed bool     `json:"allowed"`
+	Reasons []string `json:"reasons,omitempty"`
+	// Granted is the access the policy granted, if it was narrower than requested.
+	Granted *TokenRequest `json:"granted,omitempty"`
+}
+
 // TokenCheck checks if a client is authorized to request a token
 type TokenChecker interface {
-	Check(context.Context, Claims, *TokenRequest) (bool, error)
+	Check(context.Context, Claims, *TokenRequest) (*Decision, error)
 }
@@ -0,0 +1,45 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+func TestTokenRequest_Intersect(t *testing.T) {
+	t.Parallel()
+	req := api.TokenRequest{
+		Repositories: []string{"thepwagner/foo", "thepwagner/bar"},
+		Permissions:  map[string]string{"contents": "write", "issues": "read", "checks": "custom"},
+	}
+
+	cases := map[string]struct {
+		grant    api.TokenRequest
+		expected api.TokenRequest
+	}{
+		"lower level": {
+			grant:    api.TokenRequest{Permissions: map[string]string{"contents": "read", "issues": "admin"}},
+			expected: api.TokenRequest{Repositories: req.Repositories, Permissions: map[string]string{"contents": "read", "issues": "read"}},
+		},
+		"unknown levels must match": {
+			grant:    api.TokenRequest{Permissions: map[string]string{"checks": "other"}},
+			expected: api.TokenRequest{Repositories: req.Repositories, Permissions: map[string]string{}},
+		},
+		"exact unknown level": {
+			grant:    api.TokenRequest{Permissions: map[string]string{"checks": "custom"}},
+			expected: api.TokenRequest{Repositories: req.Repositories, Permissions: map[string]string{"checks": "custom"}},
+		},
+		"fewer repositories": {
+			grant:    api.TokenRequest{Repositories: []string{"ThePwagner/Bar"}, Permissions: map[string]string{"contents": "write"}},
+			expected: api.TokenRequest{Repositories: []string{"thepwagner/bar"}, Permissions: map[string]string{"contents": "write"}},
+		},
+		"nothing granted": {
+			grant:    api.TokenRequest{Repositories: []string{"thepwagner/baz"}},
+			expected: api.TokenRequest{Permissions: map[string]string{}},
+		},
+	}
+	for label, tc := range cases {
+		assert.Equal(t, tc.expected, req.Intersect(tc.grant), label)
+	}
+}
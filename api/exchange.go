@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// RFC 8693 identifiers:
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// ExchangeResponse is an RFC 8693 token exchange response.
+type ExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// OAuthError is an RFC 6749 error response.
+type OAuthError struct {
+	status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+func oauthError(status int, code string, err error) *OAuthError {
+	return &OAuthError{status: status, Code: code, Description: err.Error()}
+}
+
+// Exchange is an RFC 8693 token exchange endpoint, trading an OIDC token for a GitHub token.
+// Permissions are requested as `scope` entries like `contents:read`, repositories as `resource` values.
+func (h *Handler) Exchange(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handler.Exchange")
+	defer span.End()
+
+	var authz authorization
+	tok, oerr := h.exchangeRequest(ctx, r, &authz)
+	status := http.StatusOK
+	var err error
+	if oerr != nil {
+		status, err = oerr.status, oerr
+	}
+	h.count("exchange", status, &authz)
+	h.audit(ctx, "exchange", status, &authz, tok, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if oerr != nil {
+		h.log.Error("error exchanging token", slog.String("err", oerr.Error()))
+		span.RecordError(oerr)
+		span.SetStatus(codes.Error, oerr.Error())
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(oerr)
+		return
+	}
+
+	resp := ExchangeResponse{
+		AccessToken:     tok.Token,
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		Scope:           formatScope(tok.Permissions),
+	}
+	if !tok.ExpiresAt.IsZero() {
+		resp.ExpiresIn = int64(time.Until(tok.ExpiresAt).Seconds())
+	}
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) exchangeRequest(ctx context.Context, r *http.Request, authz *authorization) (*IssuedToken, *OAuthError) {
+	h.log.Debug("received exchange request", "url", r.URL.String())
+
+	if err := r.ParseForm(); err != nil {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", err)
+	}
+	if gt := r.PostForm.Get("grant_type"); gt != GrantTypeTokenExchange {
+		return nil, oauthError(http.StatusBadRequest, "unsupported_grant_type", fmt.Errorf("grant_type %q is not supported", gt))
+	}
+	switch tt := r.PostForm.Get("subject_token_type"); tt {
+	case TokenTypeJWT, TokenTypeIDToken:
+	default:
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", fmt.Errorf("subject_token_type %q is not supported", tt))
+	}
+	if tt := r.PostForm.Get("requested_token_type"); tt != "" && tt != TokenTypeAccessToken {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", fmt.Errorf("requested_token_type %q is not supported", tt))
+	}
+	subjectToken := r.PostForm.Get("subject_token")
+	if subjectToken == "" {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", fmt.Errorf("no subject_token"))
+	}
+
+	claims, err := h.tokenParser.Parse(ctx, subjectToken)
+	if err != nil {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", err)
+	}
+	authz.token, authz.claims = subjectToken, claims
+
+	permissions, err := parseScope(r.PostForm.Get("scope"))
+	if err != nil {
+		return nil, oauthError(http.StatusBadRequest, "invalid_scope", err)
+	}
+	repositories, err := h.parseResources(r.PostForm["resource"])
+	if err != nil {
+		return nil, oauthError(http.StatusBadRequest, "invalid_target", err)
+	}
+
+	req := TokenRequest{Repositories: repositories, Permissions: permissions}
+	if status, err := h.check(ctx, &req, authz); err != nil {
+		if status == http.StatusBadRequest {
+			return nil, oauthError(status, "invalid_request", err)
+		}
+		return nil, oauthError(status, "server_error", err)
+	}
+
+	tok, status, err := h.issue(ctx, authz)
+	switch {
+	case err == nil:
+		return tok, nil
+	case status == http.StatusUnauthorized:
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", err)
+	case status == http.StatusForbidden:
+		return nil, oauthError(http.StatusBadRequest, "invalid_scope", err)
+	default:
+		return nil, oauthError(status, "server_error", err)
+	}
+}
+
+// parseScope parses space-delimited `permission:level` scopes.
+func parseScope(scope string) (map[string]string, error) {
+	fields := strings.Fields(scope)
+	permissions := make(map[string]string, len(fields))
+	for _, f := range fields {
+		perm, level, ok := strings.Cut(f, ":")
+		if !ok || perm == "" || level == "" {
+			return nil, fmt.Errorf("invalid scope %q, expected permission:level", f)
+		}
+		permissions[perm] = level
+	}
+	return permissions, nil
+}
+
+func formatScope(permissions map[string]string) string {
+	scopes := make([]string, 0, len(permissions))
+	for perm, level := range permissions {
+		scopes = append(scopes, perm+":"+level)
+	}
+	sort.Strings(scopes)
+	return strings.Join(scopes, " ")
+}
+
+// parseResources parses repositories as `owner/repo`, or repository URLs like `https://github.com/owner/repo`.
+// URLs must be on the GitHub instance serving the owner, since tokens are issued there.
+func (h *Handler) parseResources(resources []string) ([]string, error) {
+	repositories := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		repo := resource
+		u, err := url.Parse(resource)
+		isURL := err == nil && u.Scheme != ""
+		if isURL {
+			repo = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+		}
+		owner, name, ok := strings.Cut(repo, "/")
+		if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid resource %q, expected owner/repo", resource)
+		}
+		if isURL {
+			host, ok := h.host(owner)
+			if !ok {
+				return nil, fmt.Errorf("invalid resource %q, owner %q is not configured", resource, owner)
+			}
+			if !strings.EqualFold(u.Host, host) {
+				return nil, fmt.Errorf("invalid resource %q, owner %q is served by %s", resource, owner, host)
+			}
+		}
+		repositories = append(repositories, repo)
+	}
+	return repositories, nil
+}
+
+// host returns the web host of the GitHub instance serving the owner.
+func (h *Handler) host(owner string) (string, bool) {
+	if h.instances == nil {
+		return "github.com", true
+	}
+	return h.instances.Host(owner)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ExplainResponse describes how a TokenRequest would be decided, without issuing a token.
+type ExplainResponse struct {
+	Allowed  bool             `json:"allowed"`
+	Reasons  []string         `json:"reasons,omitempty"`
+	Granted  *TokenRequest    `json:"granted,omitempty"`
+	Policies []PolicyDecision `json:"policies"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// Explain authorizes a TokenRequest and responds with the decision, instead of a token.
+func (h *Handler) Explain(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handler.Explain")
+	defer span.End()
+
+	var authz authorization
+	decision, status, err := h.explainRequest(ctx, r, &authz)
+	h.count("explain", status, &authz)
+	h.audit(ctx, "explain", status, &authz, nil, err)
+	var resp ExplainResponse
+	if decision != nil {
+		resp.Allowed = decision.Allowed
+		resp.Reasons = decision.Reasons
+		resp.Granted = decision.Granted
+		resp.Policies = decision.Policies
+	}
+	if err != nil {
+		h.log.Error("error explaining token", slog.String("err", err.Error()))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		resp.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) explainRequest(ctx context.Context, r *http.Request, authz *authorization) (*Decision, int, error) {
+	h.log.Debug("received explain request", "url", r.URL.String())
+
+	if status, err := h.authorize(ctx, r, authz); err != nil {
+		return nil, status, err
+	}
+	h.log.Debug("explained token", "allowed", authz.decision.Allowed)
+	return authz.decision, http.StatusOK, nil
+}
@@ -3,11 +3,15 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -17,12 +21,62 @@ type TokenParser interface {
 	Parse(ctx context.Context, tok string) (Claims, error)
 }
 
-type TokenIssuer func(context.Context, *TokenRequest) (string, error)
+// IssuedToken is a token returned by a TokenIssuer, with the access it was actually granted.
+type IssuedToken struct {
+	Token        string
+	ExpiresAt    time.Time
+	Permissions  map[string]string
+	Repositories []string
+}
+
+type TokenIssuer func(context.Context, *TokenRequest) (*IssuedToken, error)
+
+// TokenRevoker revokes a token previously returned by a TokenIssuer for the owner.
+// Errors caused by the request, like an invalid token or owner, should be a *ClientError.
+type TokenRevoker func(ctx context.Context, owner, token string) error
 
 type TokenResponse struct {
-	Token     string `json:"token"`
-	Revocable bool   `json:"revocable"`
-	Error     string `json:"error,omitempty"`
+	Token        string            `json:"token"`
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	Permissions  map[string]string `json:"permissions,omitempty"`
+	Repositories []string          `json:"repositories,omitempty"`
+	Revocable    bool              `json:"revocable"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// RevokeRequest is a request from a workflow to revoke a token it was issued.
+type RevokeRequest struct {
+	Token string `json:"token"`
+	// Owner the token was issued for, if it wasn't issued by the default GitHub instance.
+	Owner string `json:"owner,omitempty"`
+}
+
+// ReplayGuard only lets each client token be exchanged for one GitHub token.
+type ReplayGuard interface {
+	// Consume records a token as exchanged, failing if it already was.
+	Consume(ctx context.Context, tok string, claims Claims) error
+	// Release forgets a consumed token, when no GitHub token was issued for it.
+	Release(ctx context.Context, tok string, claims Claims) error
+}
+
+// ClientError is an error caused by the client's request rather than a failure serving it, like revoking an invalid token.
+type ClientError struct {
+	// Status is the 4xx status responded with.
+	Status int
+	Err    error
+}
+
+func (e *ClientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
+
+type RevokeResponse struct {
+	Revoked bool   `json:"revoked"`
+	Error   string `json:"error,omitempty"`
 }
 
 type Handler struct {
@@ -32,32 +86,96 @@ type Handler struct {
 	tokenParser  TokenParser
 	tokenChecker TokenChecker
 	tokenIssuer  TokenIssuer
+	tokenRevoker TokenRevoker
+	auditSink    AuditSink
+	replayGuard  ReplayGuard
+	instances    GitHubInstances
 }
 
-func NewHandler(log *slog.Logger, tracer trace.Tracer, tokenParser TokenParser, tokenChecker TokenChecker, tokenIssuer TokenIssuer) *Handler {
-	return &Handler{
+// GitHubInstances tells which GitHub instance serves each repository owner.
+type GitHubInstances interface {
+	// Configured returns true if the owner has its own config, rather than the default.
+	Configured(owner string) bool
+	// Host returns the web host of the instance serving the owner, false if none does.
+	Host(owner string) (string, bool)
+}
+
+// otherOwner labels the metrics of owners that aren't configured, so clients can't create unbounded labels.
+const otherOwner = "other"
+
+// HandlerOpt configures optional dependencies of a Handler.
+type HandlerOpt func(*Handler)
+
+// WithAuditSink records an audit event for every request.
+func WithAuditSink(sink AuditSink) HandlerOpt {
+	return func(h *Handler) {
+		h.auditSink = sink
+	}
+}
+
+// WithReplayGuard only lets each client token be exchanged for one GitHub token.
+func WithReplayGuard(guard ReplayGuard) HandlerOpt {
+	return func(h *Handler) {
+		h.replayGuard = guard
+	}
+}
+
+// WithGitHubInstances serves owners from their configured GitHub instances, and counts them by name in metrics.
+// Without instances, every owner is served by github.com and counted as "other" in metrics.
+func WithGitHubInstances(instances GitHubInstances) HandlerOpt {
+	return func(h *Handler) {
+		h.instances = instances
+	}
+}
+
+// NewHandler creates a Handler.
+func NewHandler(log *slog.Logger, tracer trace.Tracer, tokenParser TokenParser, tokenChecker TokenChecker, tokenIssuer TokenIssuer, tokenRevoker TokenRevoker, opts ...HandlerOpt) *Handler {
+	h := &Handler{
 		log:          log.With("logger", "Handler"),
 		tracer:       tracer,
 		tokenParser:  tokenParser,
 		tokenChecker: tokenChecker,
 		tokenIssuer:  tokenIssuer,
+		tokenRevoker: tokenRevoker,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "", http.StatusMethodNotAllowed)
-		return
+	switch r.Method {
+	case "POST":
+		h.Issue(w, r)
+	case "DELETE":
+		h.Revoke(w, r)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
 	}
+}
 
-	ctx, span := h.tracer.Start(r.Context(), "handler.ServeHTTP")
+// Issue authorizes a TokenRequest and responds with a token.
+func (h *Handler) Issue(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handler.Issue")
 	defer span.End()
 
-	tok, status, err := h.tokenRequest(ctx, r)
+	var authz authorization
+	tok, status, err := h.tokenRequest(ctx, r, &authz)
+	h.count("issue", status, &authz)
+	h.audit(ctx, "issue", status, &authz, tok, err)
 	resp := TokenResponse{
-		Token:     tok,
 		Revocable: true,
 	}
+	if tok != nil {
+		resp.Token = tok.Token
+		resp.ExpiresAt = &tok.ExpiresAt
+		resp.Permissions = tok.Permissions
+		resp.Repositories = tok.Repositories
+	}
 	if err != nil {
 		h.log.Error("error issuing token", slog.String("err", err.Error()))
 		span.RecordError(err)
@@ -70,44 +188,163 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func (h *Handler) tokenRequest(ctx context.Context, r *http.Request) (string, int, error) {
+func (h *Handler) tokenRequest(ctx context.Context, r *http.Request, authz *authorization) (*IssuedToken, int, error) {
 	h.log.Debug("received request", "url", r.URL.String())
 
-	claims, err := h.authenticate(ctx, r)
+	if status, err := h.authorize(ctx, r, authz); err != nil {
+		return nil, status, err
+	}
+	return h.issue(ctx, authz)
+}
+
+// issue issues a token for an authorized request, if the decision allows it.
+func (h *Handler) issue(ctx context.Context, authz *authorization) (*IssuedToken, int, error) {
+	req, decision := authz.req, authz.decision
+	if !decision.Allowed {
+		if len(decision.Reasons) > 0 {
+			return nil, http.StatusForbidden, fmt.Errorf("not authorized: %s", strings.Join(decision.Reasons, "; "))
+		}
+		return nil, http.StatusForbidden, fmt.Errorf("not authorized")
+	}
+	h.log.Debug("authorized token")
+	if decision.Granted != nil {
+		h.log.Info("downscoped token request", "repositories", decision.Granted.Repositories, "permissions", decision.Granted.Permissions)
+		req = decision.Granted
+	}
+
+	// Tokens are only used up once they're exchanged, so they can still revoke and explain:
+	if h.replayGuard != nil {
+		if err := h.replayGuard.Consume(ctx, authz.token, authz.claims); err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+	}
+	tok, err := h.tokenIssuer(ctx, req)
 	if err != nil {
-		return "", http.StatusUnauthorized, err
+		if h.replayGuard != nil {
+			// Let the client retry with the same token:
+			if err := h.replayGuard.Release(ctx, authz.token, authz.claims); err != nil {
+				h.log.Error("error releasing token", slog.String("err", err.Error()))
+			}
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return tok, http.StatusOK, nil
+}
+
+// authorization records what is known about a client's request as it is authorized.
+type authorization struct {
+	token    string
+	claims   Claims
+	req      *TokenRequest
+	decision *Decision
+}
+
+// count records the outcome of the request.
+func (h *Handler) count(handler string, status int, authz *authorization) {
+	var issuer, owner string
+	if authz.claims != nil {
+		issuer, _ = authz.claims["iss"].(string)
+	}
+	if authz.req != nil {
+		owner = authz.req.Owner()
+		if owner != "" && (h.instances == nil || !h.instances.Configured(owner)) {
+			owner = otherOwner
+		}
+	}
+	metrics.Requests.WithLabelValues(handler, strconv.Itoa(status), issuer, owner).Inc()
+}
+
+// authorize authenticates a client and checks the TokenRequest it sent, without issuing a token.
+func (h *Handler) authorize(ctx context.Context, r *http.Request, authz *authorization) (int, error) {
+	if err := h.authenticate(ctx, r, authz); err != nil {
+		return http.StatusUnauthorized, err
 	}
 
 	var req TokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return "", http.StatusBadRequest, err
-	} else if err := req.Valid(); err != nil {
-		return "", http.StatusBadRequest, err
+		return http.StatusBadRequest, err
 	}
+	return h.check(ctx, &req, authz)
+}
 
-	if authorized, err := h.tokenChecker.Check(ctx, claims, &req); err != nil {
-		return "", http.StatusInternalServerError, err
-	} else if !authorized {
-		return "", http.StatusForbidden, fmt.Errorf("not authorized")
+// check checks a TokenRequest from an authenticated client.
+func (h *Handler) check(ctx context.Context, req *TokenRequest, authz *authorization) (int, error) {
+	authz.req = req
+	if err := req.Valid(); err != nil {
+		return http.StatusBadRequest, err
 	}
-	h.log.Debug("authorized token")
 
-	tok, err := h.tokenIssuer(ctx, &req)
+	decision, err := h.tokenChecker.Check(ctx, authz.claims, req)
 	if err != nil {
-		return "", http.StatusInternalServerError, err
+		return http.StatusInternalServerError, err
 	}
+	authz.decision = decision
+	return http.StatusOK, nil
+}
 
-	return tok, http.StatusOK, nil
+// Revoke revokes a token that was issued to an authenticated client.
+func (h *Handler) Revoke(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handler.Revoke")
+	defer span.End()
+
+	var authz authorization
+	status, err := h.revokeRequest(ctx, r, &authz)
+	h.count("revoke", status, &authz)
+	h.audit(ctx, "revoke", status, &authz, nil, err)
+	resp := RevokeResponse{
+		Revoked: err == nil,
+	}
+	if err != nil {
+		h.log.Error("error revoking token", slog.String("err", err.Error()))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		resp.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func (h *Handler) authenticate(ctx context.Context, r *http.Request) (Claims, error) {
+func (h *Handler) revokeRequest(ctx context.Context, r *http.Request, authz *authorization) (int, error) {
+	h.log.Debug("received revoke request", "url", r.URL.String())
+
+	if err := h.authenticate(ctx, r, authz); err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	var req RevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, err
+	} else if req.Token == "" {
+		return http.StatusBadRequest, fmt.Errorf("no token")
+	}
+
+	if err := h.tokenRevoker(ctx, req.Owner, req.Token); err != nil {
+		var clientErr *ClientError
+		if errors.As(err, &clientErr) {
+			return clientErr.Status, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	h.log.Info("revoked token", "sub", authz.claims["sub"])
+	return http.StatusOK, nil
+}
+
+func (h *Handler) authenticate(ctx context.Context, r *http.Request, authz *authorization) error {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
-		return nil, fmt.Errorf("no authorization header")
+		return fmt.Errorf("no authorization header")
 	}
 	if !strings.HasPrefix(auth, "Bearer ") {
-		return nil, fmt.Errorf("invalid authorization header")
+		return fmt.Errorf("invalid authorization header")
 	}
 	tok := auth[len("Bearer "):]
-	return h.tokenParser.Parse(ctx, tok)
+	claims, err := h.tokenParser.Parse(ctx, tok)
+	if err != nil {
+		return err
+	}
+	authz.token, authz.claims = tok, claims
+	return nil
 }
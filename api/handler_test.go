@@ -0,0 +1,324 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// stubParser accepts any token, as a client of the issuer.
+type stubParser string
+
+func (p stubParser) Parse(context.Context, string) (api.Claims, error) {
+	return api.Claims{"iss": string(p), "sub": "test"}, nil
+}
+
+// stubChecker returns the same decision for every request.
+type stubChecker api.Decision
+
+func (c stubChecker) Check(context.Context, api.Claims, *api.TokenRequest) (*api.Decision, error) {
+	decision := api.Decision(c)
+	return &decision, nil
+}
+
+// checkerFunc decides requests with a function.
+type checkerFunc func(*api.TokenRequest) *api.Decision
+
+func (f checkerFunc) Check(_ context.Context, _ api.Claims, req *api.TokenRequest) (*api.Decision, error) {
+	return f(req), nil
+}
+
+func stubIssuer(_ context.Context, req *api.TokenRequest) (*api.IssuedToken, error) {
+	return &api.IssuedToken{Token: "ghs_test", Repositories: req.Repositories, Permissions: req.Permissions}, nil
+}
+
+// stubInstances serves owners from the hosts, and any other owner from github.com.
+type stubInstances map[string]string
+
+func (i stubInstances) Configured(owner string) bool {
+	_, ok := i[owner]
+	return ok
+}
+
+func (i stubInstances) Host(owner string) (string, bool) {
+	if host, ok := i[owner]; ok {
+		return host, true
+	}
+	return "github.com", true
+}
+
+// recordingSink records audit events.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []api.AuditEvent
+}
+
+func (s *recordingSink) Audit(_ context.Context, event *api.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func (s *recordingSink) last(t *testing.T) api.AuditEvent {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.NotEmpty(t, s.events)
+	return s.events[len(s.events)-1]
+}
+
+func newTestHandler(checker api.TokenChecker, issuer api.TokenIssuer, revoker api.TokenRevoker, sink api.AuditSink) *api.Handler {
+	return api.NewHandler(slog.Default(), noop.NewTracerProvider().Tracer(""), stubParser("https://issuer.example"), checker, issuer, revoker, api.WithAuditSink(sink))
+}
+
+// serve sends a request to the handler with an OIDC token.
+func serve(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer oidc-jwt")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler_MetricsOwner(t *testing.T) {
+	t.Parallel()
+	const issuer = "https://metrics.example"
+	h := api.NewHandler(slog.Default(), noop.NewTracerProvider().Tracer(""), stubParser(issuer), stubChecker{Allowed: true}, stubIssuer, nil, api.WithGitHubInstances(stubInstances{"thepwagner": "github.com"}))
+
+	for _, repo := range []string{"thepwagner/gtfo", "thepwagner/other", "attacker-1/repo", "attacker-2/repo"} {
+		rec := serve(h, "POST", "/", `{"repositories":["`+repo+`"],"permissions":{"contents":"read"}}`)
+		assert.Equal(t, http.StatusOK, rec.Code, repo)
+	}
+
+	// Configured owners are labelled, any other owner is counted together:
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.Requests.WithLabelValues("issue", "200", issuer, "thepwagner")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.Requests.WithLabelValues("issue", "200", issuer, "other")))
+	assert.False(t, metrics.Requests.DeleteLabelValues("issue", "200", issuer, "attacker-1"))
+}
+
+func TestHandler_ExchangeResourceHost(t *testing.T) {
+	t.Parallel()
+	h := api.NewHandler(slog.Default(), noop.NewTracerProvider().Tracer(""), stubParser("https://issuer.example"), stubChecker{Allowed: true}, stubIssuer, nil, api.WithGitHubInstances(stubInstances{"acme": "github.acme.internal"}))
+
+	cases := map[string]int{
+		"thepwagner/gtfo":                              http.StatusOK,
+		"https://github.com/thepwagner/gtfo":           http.StatusOK,
+		"https://GitHub.com/thepwagner/gtfo.git":       http.StatusOK,
+		"https://github.acme.internal/acme/app":        http.StatusOK,
+		"https://evil.example/thepwagner/gtfo":         http.StatusBadRequest,
+		"https://github.com/acme/app":                  http.StatusBadRequest,
+		"https://github.acme.internal/thepwagner/gtfo": http.StatusBadRequest,
+	}
+	for resource, status := range cases {
+		form := url.Values{
+			"grant_type":         {api.GrantTypeTokenExchange},
+			"subject_token":      {"oidc-jwt"},
+			"subject_token_type": {api.TokenTypeJWT},
+			"scope":              {"contents:read"},
+			"resource":           {resource},
+		}
+		req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.Exchange(rec, req)
+		assert.Equal(t, status, rec.Code, resource)
+		if status != http.StatusOK {
+			assert.Contains(t, rec.Body.String(), "invalid_target", resource)
+		}
+	}
+}
+
+func TestHandler_Revoke(t *testing.T) {
+	t.Parallel()
+	var revokedOwner, revokedToken string
+	revoker := func(_ context.Context, owner, token string) error {
+		revokedOwner, revokedToken = owner, token
+		switch token {
+		case "ghs_unknown":
+			return &api.ClientError{Status: http.StatusNotFound, Err: errors.New("token not found")}
+		case "ghs_broken":
+			return errors.New("github is down")
+		}
+		return nil
+	}
+	h := http.HandlerFunc(newTestHandler(stubChecker{Allowed: true}, stubIssuer, revoker, nil).Revoke)
+
+	rec := serve(h, "POST", "/v1/revoke", `{"token":"ghs_test","owner":"acme"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"revoked":true}`, rec.Body.String())
+	assert.Equal(t, "acme", revokedOwner)
+	assert.Equal(t, "ghs_test", revokedToken)
+
+	cases := map[string]int{
+		`{"token":"ghs_unknown"}`: http.StatusNotFound,
+		`{"token":"ghs_broken"}`:  http.StatusInternalServerError,
+		`{}`:                      http.StatusBadRequest,
+		`not json`:                http.StatusBadRequest,
+	}
+	for body, status := range cases {
+		rec := serve(h, "POST", "/v1/revoke", body)
+		assert.Equal(t, status, rec.Code, body)
+		var resp api.RevokeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), body)
+		assert.False(t, resp.Revoked, body)
+		assert.NotEmpty(t, resp.Error, body)
+	}
+}
+
+const tokenRequest = `{"repositories":["thepwagner/gtfo"],"permissions":{"contents":"write","issues":"write"}}`
+
+// unexpectedIssuer fails the test if a token is issued.
+func unexpectedIssuer(t *testing.T) api.TokenIssuer {
+	t.Helper()
+	return func(context.Context, *api.TokenRequest) (*api.IssuedToken, error) {
+		t.Error("unexpected token issued")
+		return nil, errors.New("unexpected")
+	}
+}
+
+func TestHandler_Explain(t *testing.T) {
+	t.Parallel()
+	decision := stubChecker{
+		Allowed:  true,
+		Granted:  &api.TokenRequest{Repositories: []string{"thepwagner/gtfo"}, Permissions: map[string]string{"contents": "read"}},
+		Policies: []api.PolicyDecision{{Repository: "thepwagner/.github", SHA: "abc123", Owner: true, Allowed: true}},
+	}
+	h := http.HandlerFunc(newTestHandler(decision, unexpectedIssuer(t), nil, nil).Explain)
+
+	rec := serve(h, "POST", "/v1/explain", tokenRequest)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp api.ExplainResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, decision.Granted, resp.Granted)
+	assert.Equal(t, decision.Policies, resp.Policies)
+	assert.Empty(t, resp.Error)
+
+	// Invalid requests are explained as errors:
+	rec = serve(h, "POST", "/v1/explain", `{"repositories":["thepwagner/gtfo"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "no permissions", resp.Error)
+}
+
+func TestHandler_Denied(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler(stubChecker{Reasons: []string{"untrusted workflow", "branch is not protected"}}, unexpectedIssuer(t), nil, nil)
+
+	rec := serve(h, "POST", "/v1/token", tokenRequest)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	var resp api.TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Empty(t, resp.Token)
+	assert.Equal(t, "not authorized: untrusted workflow; branch is not protected", resp.Error)
+
+	// Without reasons:
+	h = newTestHandler(stubChecker{}, unexpectedIssuer(t), nil, nil)
+	rec = serve(h, "POST", "/v1/token", tokenRequest)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error":"not authorized"`)
+}
+
+func TestHandler_PartialGrant(t *testing.T) {
+	t.Parallel()
+	grant := api.TokenRequest{Permissions: map[string]string{"contents": "read"}}
+	checker := checkerFunc(func(req *api.TokenRequest) *api.Decision {
+		granted := req.Intersect(grant)
+		return &api.Decision{Allowed: true, Granted: &granted}
+	})
+	var issuedReq *api.TokenRequest
+	issuer := func(ctx context.Context, req *api.TokenRequest) (*api.IssuedToken, error) {
+		issuedReq = req
+		return stubIssuer(ctx, req)
+	}
+	h := newTestHandler(checker, issuer, nil, nil)
+
+	// Only the granted access is issued:
+	rec := serve(h, "POST", "/v1/token", tokenRequest)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp api.TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "ghs_test", resp.Token)
+	assert.Equal(t, map[string]string{"contents": "read"}, resp.Permissions)
+	assert.Equal(t, []string{"thepwagner/gtfo"}, resp.Repositories)
+	require.NotNil(t, issuedReq)
+	assert.Equal(t, map[string]string{"contents": "read"}, issuedReq.Permissions)
+}
+
+func TestHandler_Audit(t *testing.T) {
+	t.Parallel()
+	grant := api.TokenRequest{Permissions: map[string]string{"contents": "read"}}
+	checker := checkerFunc(func(req *api.TokenRequest) *api.Decision {
+		if req.Owner() == "denied" {
+			return &api.Decision{Reasons: []string{"untrusted workflow"}}
+		}
+		granted := req.Intersect(grant)
+		return &api.Decision{Allowed: true, Granted: &granted}
+	})
+	issuer := func(ctx context.Context, req *api.TokenRequest) (*api.IssuedToken, error) {
+		if req.Owner() == "broken" {
+			return nil, errors.New("github is down")
+		}
+		return stubIssuer(ctx, req)
+	}
+	revoker := func(context.Context, string, string) error { return errors.New("token not found") }
+	sink := &recordingSink{}
+	h := newTestHandler(checker, issuer, revoker, sink)
+
+	// Issued tokens record the requested and granted access, never the token:
+	serve(h, "POST", "/v1/token", tokenRequest)
+	event := sink.last(t)
+	assert.Equal(t, "issue", event.Handler)
+	assert.Equal(t, http.StatusOK, event.Status)
+	assert.Equal(t, "https://issuer.example", event.Issuer)
+	assert.Equal(t, "test", event.Subject)
+	assert.True(t, event.Allowed)
+	assert.Equal(t, []string{"thepwagner/gtfo"}, event.Repositories)
+	assert.Equal(t, map[string]string{"contents": "write", "issues": "write"}, event.Permissions)
+	require.NotNil(t, event.Granted)
+	assert.Equal(t, map[string]string{"contents": "read"}, event.Granted.Permissions)
+	assert.NotNil(t, event.ExpiresAt)
+	assert.Empty(t, event.Error)
+	body, err := json.Marshal(event)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "ghs_test")
+
+	// Denials record the reasons:
+	serve(h, "POST", "/v1/token", `{"repositories":["denied/repo"],"permissions":{"contents":"read"}}`)
+	event = sink.last(t)
+	assert.Equal(t, http.StatusForbidden, event.Status)
+	assert.False(t, event.Allowed)
+	assert.Equal(t, []string{"untrusted workflow"}, event.Reasons)
+	assert.Nil(t, event.Granted)
+
+	// Failures record the error:
+	serve(h, "POST", "/v1/token", `{"repositories":["broken/repo"],"permissions":{"contents":"read"}}`)
+	event = sink.last(t)
+	assert.Equal(t, http.StatusInternalServerError, event.Status)
+	assert.True(t, event.Allowed)
+	assert.Nil(t, event.ExpiresAt)
+	assert.Equal(t, "github is down", event.Error)
+
+	serve(http.HandlerFunc(h.Revoke), "POST", "/v1/revoke", `{"token":"ghs_test"}`)
+	event = sink.last(t)
+	assert.Equal(t, "revoke", event.Handler)
+	assert.Equal(t, "token not found", event.Error)
+
+	serve(http.HandlerFunc(h.Explain), "POST", "/v1/explain", tokenRequest)
+	assert.Equal(t, "explain", sink.last(t).Handler)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// HealthChecker reports the health of named components, nil errors are healthy.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) map[string]error
+}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Health serves liveness and readiness probes.
+type Health struct {
+	checkers []HealthChecker
+}
+
+func NewHealth(checkers ...HealthChecker) *Health {
+	return &Health{checkers: checkers}
+}
+
+// Live responds if the process is serving requests.
+func (h *Health) Live(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Ready responds with the health of every component, failing if any is unhealthy.
+// Components of a Degradable checker only fail readiness once all of them are unhealthy.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	resp := HealthResponse{Status: "ok", Checks: map[string]string{}}
+	for _, checker := range h.checkers {
+		checks := checker.CheckHealth(r.Context())
+		var failed int
+		for component, err := range checks {
+			if err != nil {
+				failed++
+				resp.Checks[component] = err.Error()
+			} else {
+				resp.Checks[component] = "ok"
+			}
+		}
+		if failed == 0 {
+			continue
+		}
+		if _, ok := checker.(degradable); ok && failed < len(checks) {
+			if resp.Status == "ok" {
+				resp.Status = "degraded"
+			}
+			continue
+		}
+		status = http.StatusServiceUnavailable
+		resp.Status = "unavailable"
+	}
+	writeHealth(w, status, resp)
+}
+
+// Degradable wraps a checker of independent components, like each trusted issuer, so one failing doesn't fail readiness.
+// Failures are still reported, and readiness fails once every component is unhealthy.
+func Degradable(checker HealthChecker) HealthChecker {
+	return degradable{checker}
+}
+
+type degradable struct {
+	HealthChecker
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
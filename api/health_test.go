@@ -0,0 +1,74 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+// stubHealth reports the same health on every check.
+type stubHealth map[string]error
+
+func (h stubHealth) CheckHealth(context.Context) map[string]error {
+	return h
+}
+
+func TestHealth_Ready(t *testing.T) {
+	t.Parallel()
+	unavailable := errors.New("unavailable")
+	cases := map[string]struct {
+		checkers []api.HealthChecker
+		code     int
+		status   string
+	}{
+		"healthy": {
+			checkers: []api.HealthChecker{stubHealth{"github/acme": nil}, api.Degradable(stubHealth{"oidc/a": nil, "oidc/b": nil})},
+			code:     http.StatusOK,
+			status:   "ok",
+		},
+		"unhealthy": {
+			checkers: []api.HealthChecker{stubHealth{"github/acme": unavailable}, api.Degradable(stubHealth{"oidc/a": nil})},
+			code:     http.StatusServiceUnavailable,
+			status:   "unavailable",
+		},
+		"degraded": {
+			checkers: []api.HealthChecker{stubHealth{"github/acme": nil}, api.Degradable(stubHealth{"oidc/a": nil, "oidc/b": unavailable})},
+			code:     http.StatusOK,
+			status:   "degraded",
+		},
+		"degraded entirely": {
+			checkers: []api.HealthChecker{stubHealth{"github/acme": nil}, api.Degradable(stubHealth{"oidc/a": unavailable, "oidc/b": unavailable})},
+			code:     http.StatusServiceUnavailable,
+			status:   "unavailable",
+		},
+	}
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			api.NewHealth(tc.checkers...).Ready(rec, httptest.NewRequest("GET", "/readyz", nil))
+			assert.Equal(t, tc.code, rec.Code)
+
+			var resp api.HealthResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, tc.status, resp.Status)
+			for _, checker := range tc.checkers {
+				for component, err := range checker.CheckHealth(context.Background()) {
+					if err != nil {
+						assert.Equal(t, err.Error(), resp.Checks[component], "failures are reported")
+					} else {
+						assert.Equal(t, "ok", resp.Checks[component])
+					}
+				}
+			}
+		})
+	}
+}
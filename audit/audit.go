@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+type Config struct {
+	// Where to write events: "stdout", "file" or "webhook". Auditing is disabled if empty.
+	Sink string
+	// Path of the JSONL file, for the "file" sink.
+	Path string
+	// URL events are POSTed to, for the "webhook" sink.
+	URL     string
+	Headers map[string]string
+	// Claims of the OIDC token to include in events, beyond the issuer and subject.
+	Claims []string
+}
+
+// Closer is implemented by sinks that send events in the background, to flush them on shutdown.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// NewSink creates the configured api.AuditSink, or nil if auditing is disabled.
+// If the sink implements Closer, it must be closed to flush its events.
+func NewSink(log *slog.Logger, cfg Config, client *http.Client) (api.AuditSink, error) {
+	var sink api.AuditSink
+	switch cfg.Sink {
+	case "":
+		return nil, nil
+	case "stdout":
+		sink = NewWriterSink(os.Stdout)
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("audit file sink requires a path")
+		}
+		fileSink, err := NewFileSink(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("audit webhook sink requires a url")
+		}
+		sink = NewWebhookSink(log, client, cfg.URL, cfg.Headers)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", cfg.Sink)
+	}
+	return NewClaimsFilter(sink, cfg.Claims...), nil
+}
+
+// ClaimsFilter is an api.AuditSink that only passes selected claims to the next sink.
+type ClaimsFilter struct {
+	next   api.AuditSink
+	claims []string
+}
+
+func NewClaimsFilter(next api.AuditSink, claims ...string) *ClaimsFilter {
+	return &ClaimsFilter{next: next, claims: claims}
+}
+
+var (
+	_ api.AuditSink = (*ClaimsFilter)(nil)
+	_ Closer        = (*ClaimsFilter)(nil)
+)
+
+func (f *ClaimsFilter) Audit(ctx context.Context, event *api.AuditEvent) error {
+	filtered := *event
+	filtered.Claims = nil
+	for _, claim := range f.claims {
+		v, ok := event.Claims[claim]
+		if !ok {
+			continue
+		}
+		if filtered.Claims == nil {
+			filtered.Claims = make(api.Claims, len(f.claims))
+		}
+		filtered.Claims[claim] = v
+	}
+	return f.next.Audit(ctx, &filtered)
+}
+
+// Close closes the next sink, if it implements Closer.
+func (f *ClaimsFilter) Close(ctx context.Context) error {
+	if closer, ok := f.next.(Closer); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
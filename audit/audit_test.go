@@ -0,0 +1,149 @@
+package audit_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/audit"
+)
+
+func testEvent() *api.AuditEvent {
+	return &api.AuditEvent{
+		Handler: "issue",
+		Status:  http.StatusOK,
+		Issuer:  "https://token.actions.githubusercontent.com",
+		Subject: "repo:thepwagner/gtfo:ref:refs/heads/main",
+		Claims: api.Claims{
+			"iss":        "https://token.actions.githubusercontent.com",
+			"repository": "thepwagner/gtfo",
+			"actor":      "thepwagner",
+		},
+		Repositories: []string{"thepwagner/gtfo"},
+		Permissions:  map[string]string{"contents": "read"},
+		Allowed:      true,
+		Policies:     []api.PolicyDecision{{Repository: "thepwagner/.github", SHA: "abc123", Owner: true, Allowed: true}},
+	}
+}
+
+func TestNewSink_File(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := audit.NewSink(slog.Default(), audit.Config{Sink: "file", Path: path, Claims: []string{"repository", "missing"}}, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, sink.Audit(ctx, testEvent()))
+	require.NoError(t, sink.Audit(ctx, testEvent()))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		var event api.AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, api.Claims{"repository": "thepwagner/gtfo"}, event.Claims)
+		assert.Equal(t, "abc123", event.Policies[0].SHA)
+		assert.True(t, event.Allowed)
+	}
+	assert.Equal(t, 2, lines)
+}
+
+func TestNewSink_Webhook(t *testing.T) {
+	t.Parallel()
+	received := make(chan api.AuditEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var event api.AuditEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer srv.Close()
+
+	sink, err := audit.NewSink(slog.Default(), audit.Config{
+		Sink:    "webhook",
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}, srv.Client())
+	require.NoError(t, err)
+	require.NoError(t, sink.Audit(context.Background(), testEvent()))
+
+	require.NoError(t, sink.(audit.Closer).Close(context.Background()))
+
+	event := <-received
+	assert.Equal(t, "repo:thepwagner/gtfo:ref:refs/heads/main", event.Subject)
+	assert.Nil(t, event.Claims)
+}
+
+func TestWebhookSink_Async(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	received := make(chan api.AuditEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var event api.AuditEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer srv.Close()
+	sink := audit.NewWebhookSink(slog.Default(), srv.Client(), srv.URL, nil)
+	ctx := context.Background()
+
+	// Events are queued without waiting for the webhook:
+	require.NoError(t, sink.Audit(ctx, testEvent()))
+	require.NoError(t, sink.Audit(ctx, testEvent()))
+	assert.Empty(t, received)
+
+	// Closing waits for queued events, until the context is cancelled:
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, sink.Close(timeoutCtx))
+	close(release)
+	require.NoError(t, sink.Close(ctx))
+	assert.Len(t, received, 2)
+
+	assert.Error(t, sink.Audit(ctx, testEvent()), "closed")
+}
+
+func TestWebhookSink_Error(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// Failures are logged, without failing the request that was audited:
+	sink := audit.NewWebhookSink(slog.Default(), srv.Client(), srv.URL, nil)
+	require.NoError(t, sink.Audit(context.Background(), testEvent()))
+	require.NoError(t, sink.Close(context.Background()))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestNewSink_Invalid(t *testing.T) {
+	t.Parallel()
+
+	sink, err := audit.NewSink(slog.Default(), audit.Config{}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, sink)
+
+	_, err = audit.NewSink(slog.Default(), audit.Config{Sink: "syslog"}, nil)
+	assert.Error(t, err)
+	_, err = audit.NewSink(slog.Default(), audit.Config{Sink: "file"}, nil)
+	assert.Error(t, err)
+}
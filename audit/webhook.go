@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+const (
+	// webhookQueueSize is how many events may wait to be sent, before new events are dropped.
+	webhookQueueSize = 1000
+	// webhookTimeout bounds sending each event.
+	webhookTimeout = 10 * time.Second
+)
+
+var errWebhookQueueFull = errors.New("audit webhook queue is full, dropping event")
+
+// WebhookSink POSTs each event as JSON to a URL.
+// Events are queued and sent in the background, so a slow webhook doesn't delay requests.
+type WebhookSink struct {
+	log     *slog.Logger
+	client  *http.Client
+	url     string
+	headers map[string]string
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan queuedEvent
+	done   chan struct{}
+}
+
+type queuedEvent struct {
+	ctx   context.Context
+	event *api.AuditEvent
+}
+
+// NewWebhookSink creates a WebhookSink, sending events until it is closed.
+func NewWebhookSink(log *slog.Logger, client *http.Client, url string, headers map[string]string) *WebhookSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &WebhookSink{
+		log:     log.With("logger", "audit.WebhookSink"),
+		client:  client,
+		url:     url,
+		headers: headers,
+		queue:   make(chan queuedEvent, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+var _ api.AuditSink = (*WebhookSink)(nil)
+
+// Audit queues an event to be sent, failing if the queue is full or the sink is closed.
+func (s *WebhookSink) Audit(ctx context.Context, event *api.AuditEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit webhook sink is closed")
+	}
+	select {
+	// The event outlives the request, but stays in its trace:
+	case s.queue <- queuedEvent{ctx: context.WithoutCancel(ctx), event: event}:
+		return nil
+	default:
+		return errWebhookQueueFull
+	}
+}
+
+// Close stops accepting events, and waits for queued events to be sent until the context is cancelled.
+func (s *WebhookSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flushing audit events: %w", ctx.Err())
+	}
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	for queued := range s.queue {
+		if err := s.send(queued.ctx, queued.event); err != nil {
+			s.log.Error("error sending audit event", slog.String("err", err.Error()))
+		}
+	}
+}
+
+func (s *WebhookSink) send(ctx context.Context, event *api.AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshaling audit event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating audit request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending audit event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sending audit event: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+// WriterSink writes events as JSON lines.
+type WriterSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{enc: json.NewEncoder(w)}
+}
+
+// NewFileSink appends events to a JSONL file.
+func NewFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return NewWriterSink(f), nil
+}
+
+var _ api.AuditSink = (*WriterSink)(nil)
+
+func (s *WriterSink) Audit(_ context.Context, event *api.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(event); err != nil {
+		return fmt.Errorf("writing audit event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	gh "github.com/google/go-github/v62/github"
+	"github.com/thepwagner/github-token-factory-oidc/github"
+)
+
+// PolicyPath is where policies are loaded from in each repository.
+const PolicyPath = ".github/tokens.rego"
+
+// GitHubPolicySource loads policies from `.github/tokens.rego` in each repository's default branch.
+type GitHubPolicySource struct {
+	log    *slog.Logger
+	github *github.Clients
+	cache  *PolicyCache
+}
+
+var _ PolicySource = (*GitHubPolicySource)(nil)
+
+// NewGitHubPolicySource creates a GitHubPolicySource. If cache is non-nil, fetched policies are cached.
+func NewGitHubPolicySource(log *slog.Logger, github *github.Clients, cache *PolicyCache) *GitHubPolicySource {
+	return &GitHubPolicySource{
+		log:    log.With("logger", "auth.GitHubPolicySource"),
+		github: github,
+		cache:  cache,
+	}
+}
+
+func (s *GitHubPolicySource) Policy(ctx context.Context, repo string) (*Policy, error) {
+	repoParts := strings.Split(repo, "/")
+	if len(repoParts) != 2 {
+		return nil, fmt.Errorf("invalid repo: %s", repo)
+	}
+
+	var policy *Policy
+	err := s.github.WithAppClient(ctx, repoParts[0], func(client *github.Client) error {
+		var err error
+		policy, err = s.policy(ctx, client, repo, repoParts)
+		return err
+	})
+	return policy, err
+}
+
+func (s *GitHubPolicySource) policy(ctx context.Context, client *github.Client, repo string, repoParts []string) (*Policy, error) {
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/contents/%s", repoParts[0], repoParts[1], PolicyPath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("building policy request: %w", err)
+	}
+
+	// Revalidate cached policies, unmodified responses don't count against the rate limit:
+	var cached *cachedPolicy
+	if s.cache != nil {
+		cached = s.cache.get(repo)
+	}
+	if cached != nil {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	var fc gh.RepositoryContent
+	resp, err := client.Do(ctx, req, &fc)
+	if resp != nil && resp.StatusCode == http.StatusNotModified && cached != nil {
+		s.log.Debug("cached policy not modified", "repository", repo, "policy_sha", cached.SHA)
+		return cached.Policy, nil
+	}
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			s.Invalidate(repo)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("fetching repo policy: %w", err)
+	}
+
+	s.log.Info("fetched policy", "repository", repo, "policy_sha", fc.GetSHA())
+	policy := cached.reuse(fc.GetSHA())
+	if policy == nil {
+		policyRaw, err := fc.GetContent()
+		if err != nil {
+			return nil, fmt.Errorf("fetching repo policy content: %w", err)
+		}
+
+		rego, err := NewRego(ctx, s.log, policyRaw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing repo policy: %w", err)
+		}
+		policy = &Policy{
+			Repository: repo,
+			SHA:        fc.GetSHA(),
+			Rego:       rego,
+		}
+	}
+	if s.cache != nil {
+		s.cache.put(policy, resp.Header.Get("ETag"))
+	}
+	return policy, nil
+}
+
+// Invalidate drops any cached policy for a repository.
+func (s *GitHubPolicySource) Invalidate(repo string) {
+	if s.cache != nil {
+		s.cache.Invalidate(repo)
+	}
+}
@@ -0,0 +1,109 @@
+package checker_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/checker"
+	"github.com/thepwagner/github-token-factory-oidc/github"
+)
+
+// fakePolicyRepo serves a policy from `acme/repo`, answering requests for the current ETag with 304 Not Modified.
+type fakePolicyRepo struct {
+	*httptest.Server
+	fetched     atomic.Int32
+	notModified atomic.Int32
+}
+
+func newFakePolicyRepo(t *testing.T, policy string) *fakePolicyRepo {
+	t.Helper()
+	f := &fakePolicyRepo{}
+	const etag, sha = `"policy-v1"`, "0123456789abcdef"
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v3/orgs/acme/installation", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"id": 1}`))
+	})
+	mux.HandleFunc("POST /api/v3/app/installations/1/access_tokens", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"token": "ghs_installation", "expires_at": "2030-01-01T00:00:00Z"}`))
+	})
+	mux.HandleFunc("GET /api/v3/repos/acme/repo/contents/.github/tokens.rego", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			f.notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		f.fetched.Add(1)
+		w.Header().Set("ETag", etag)
+		_, _ = fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "sha": %q, "content": %q}`, sha, base64.StdEncoding.EncodeToString([]byte(policy)))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newGitHubClients(t *testing.T, baseURL string) *github.Clients {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	clients, err := github.NewClients(context.Background(), slog.Default(), http.DefaultTransport, map[string]github.Config{
+		"acme": {AppID: 1, PrivateKey: string(keyPEM), BaseURL: baseURL},
+	}, 0)
+	require.NoError(t, err)
+	return clients
+}
+
+func TestGitHubPolicySource_NotModified(t *testing.T) {
+	t.Parallel()
+	gh := newFakePolicyRepo(t, allowPolicy)
+	src := checker.NewGitHubPolicySource(slog.Default(), newGitHubClients(t, gh.URL), checker.NewPolicyCache(10, time.Hour))
+	ctx := context.Background()
+
+	policy, err := src.Policy(ctx, "acme/repo")
+	require.NoError(t, err)
+	require.NotNil(t, policy)
+	assert.Equal(t, "0123456789abcdef", policy.SHA)
+	assert.Equal(t, int32(1), gh.fetched.Load())
+
+	// The cached policy is revalidated, and reused without compiling it again:
+	cached, err := src.Policy(ctx, "acme/repo")
+	require.NoError(t, err)
+	assert.Same(t, policy, cached)
+	assert.Equal(t, int32(1), gh.fetched.Load())
+	assert.Equal(t, int32(1), gh.notModified.Load())
+
+	// Invalidated policies are fetched again:
+	src.Invalidate("acme/repo")
+	refetched, err := src.Policy(ctx, "acme/repo")
+	require.NoError(t, err)
+	assert.Equal(t, policy.SHA, refetched.SHA)
+	assert.Equal(t, int32(2), gh.fetched.Load())
+}
+
+func TestGitHubPolicySource_NoCache(t *testing.T) {
+	t.Parallel()
+	gh := newFakePolicyRepo(t, allowPolicy)
+	src := checker.NewGitHubPolicySource(slog.Default(), newGitHubClients(t, gh.URL), nil)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := src.Policy(ctx, "acme/repo")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), gh.fetched.Load())
+	assert.Equal(t, int32(0), gh.notModified.Load())
+}
@@ -0,0 +1,151 @@
+package checker
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec // matches git's blob SHAs, not used for security
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/thepwagner/github-token-factory-oidc/filewatch"
+)
+
+// LocalPolicySource loads policies from a directory or OPA bundle tarball, reloading them when files change.
+// The policy of `owner/repo` is loaded from `owner/repo.rego`, so the default owner policy is `owner/.github.rego`.
+type LocalPolicySource struct {
+	log  *slog.Logger
+	path string
+
+	mu       sync.RWMutex
+	policies map[string]*Policy
+}
+
+var _ PolicySource = (*LocalPolicySource)(nil)
+
+// NewLocalPolicySource loads policies from path, and watches for changes until the context is cancelled.
+func NewLocalPolicySource(ctx context.Context, log *slog.Logger, path string) (*LocalPolicySource, error) {
+	s := &LocalPolicySource{
+		log:  log.With("logger", "auth.LocalPolicySource", "path", path),
+		path: path,
+	}
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+	if err := s.watch(watcher); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go filewatch.Run(ctx, watcher, func() { s.reload(ctx, watcher) }, func(err error) {
+		s.log.Error("watching policies", slog.String("err", err.Error()))
+	})
+	return s, nil
+}
+
+func (s *LocalPolicySource) Policy(_ context.Context, repo string) (*Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policies[strings.ToLower(repo)], nil
+}
+
+func (s *LocalPolicySource) load(ctx context.Context) error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("loading policies: %w", err)
+	}
+	var loader bundle.DirectoryLoader
+	if fi.IsDir() {
+		loader = bundle.NewDirectoryLoader(s.path)
+	} else {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return fmt.Errorf("opening bundle: %w", err)
+		}
+		defer f.Close()
+		loader = bundle.NewTarballLoaderWithBaseURL(f, s.path)
+	}
+	b, err := bundle.NewCustomReader(loader).Read()
+	if err != nil {
+		return fmt.Errorf("reading policies: %w", err)
+	}
+
+	policies := make(map[string]*Policy, len(b.Modules))
+	for _, m := range b.Modules {
+		repo := strings.TrimSuffix(strings.TrimPrefix(path.Clean("/"+m.Path), "/"), ".rego")
+		if strings.Count(repo, "/") != 1 {
+			s.log.Warn("ignoring policy outside an owner directory", "file", m.Path)
+			continue
+		}
+		rego, err := NewRego(ctx, s.log, string(m.Raw))
+		if err != nil {
+			return fmt.Errorf("parsing policy %q: %w", m.Path, err)
+		}
+		policies[strings.ToLower(repo)] = &Policy{
+			Repository: repo,
+			SHA:        blobSHA(m.Raw),
+			Rego:       rego,
+		}
+	}
+
+	s.mu.Lock()
+	s.policies = policies
+	s.mu.Unlock()
+	s.log.Info("loaded policies", "policies", len(policies))
+	return nil
+}
+
+// watch adds the policy directory and its subdirectories, or the directory containing the bundle, to the watcher.
+func (s *LocalPolicySource) watch(watcher *fsnotify.Watcher) error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("watching policies: %w", err)
+	}
+	if !fi.IsDir() {
+		// Watch the parent, so the bundle can be replaced by a rename:
+		return watcher.Add(filepath.Dir(s.path))
+	}
+	return filepath.WalkDir(s.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(p); err != nil {
+			return fmt.Errorf("watching %q: %w", p, err)
+		}
+		return nil
+	})
+}
+
+func (s *LocalPolicySource) reload(ctx context.Context, watcher *fsnotify.Watcher) {
+	// New owner directories must be watched too:
+	if err := s.watch(watcher); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.log.Error("watching policies", slog.String("err", err.Error()))
+	}
+	// Keep serving the previous policies if the new ones are broken:
+	if err := s.load(ctx); err != nil {
+		s.log.Error("reloading policies", slog.String("err", err.Error()))
+	}
+}
+
+// blobSHA returns the git blob SHA of a policy, so policies can be compared with their source repository.
+func blobSHA(content []byte) string {
+	h := sha1.New() //nolint:gosec
+	_, _ = fmt.Fprintf(h, "blob %d\x00", len(content))
+	_, _ = h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
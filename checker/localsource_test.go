@@ -0,0 +1,105 @@
+package checker_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/checker"
+)
+
+const (
+	allowPolicy = "package tokens\nallow = true\n"
+	denyPolicy  = "package tokens\nallow = false\n"
+)
+
+func TestLocalPolicySource_Directory(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	writePolicy(t, filepath.Join(dir, "thepwagner", "foo.rego"), allowPolicy)
+	writePolicy(t, filepath.Join(dir, "thepwagner", "bar.rego"), denyPolicy)
+
+	src, err := checker.NewLocalPolicySource(ctx, slog.Default(), dir)
+	require.NoError(t, err)
+	r := checker.NewRepoRego(slog.Default(), src, ".github", true)
+
+	foo := &api.TokenRequest{Repositories: []string{"thepwagner/foo"}, Permissions: map[string]string{"contents": "read"}}
+	bar := &api.TokenRequest{Repositories: []string{"thepwagner/bar"}, Permissions: map[string]string{"contents": "read"}}
+
+	dec, err := r.Check(ctx, actionClaims, foo)
+	require.NoError(t, err)
+	assert.True(t, dec.Allowed)
+	require.Len(t, dec.Policies, 1)
+	assert.Equal(t, "thepwagner/foo", dec.Policies[0].Repository)
+	assert.NotEmpty(t, dec.Policies[0].SHA)
+
+	dec, err = r.Check(ctx, actionClaims, bar)
+	require.NoError(t, err)
+	assert.False(t, dec.Allowed)
+
+	// Adding an owner policy is picked up by the watcher:
+	writePolicy(t, filepath.Join(dir, "thepwagner", ".github.rego"), allowPolicy)
+	assert.Eventually(t, func() bool {
+		dec, err := r.Check(ctx, actionClaims, bar)
+		return err == nil && dec.Allowed
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLocalPolicySource_Bundle(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	writeBundle(t, bundlePath, map[string]string{"thepwagner/.github.rego": denyPolicy})
+
+	src, err := checker.NewLocalPolicySource(ctx, slog.Default(), bundlePath)
+	require.NoError(t, err)
+
+	policy, err := src.Policy(ctx, "thepwagner/.github")
+	require.NoError(t, err)
+	require.NotNil(t, policy)
+	assert.Equal(t, "thepwagner/.github", policy.Repository)
+	policy, err = src.Policy(ctx, "thepwagner/foo")
+	require.NoError(t, err)
+	assert.Nil(t, policy)
+
+	writeBundle(t, bundlePath, map[string]string{"thepwagner/foo.rego": allowPolicy})
+	assert.Eventually(t, func() bool {
+		policy, err := src.Policy(ctx, "thepwagner/foo")
+		return err == nil && policy != nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func writePolicy(t *testing.T, path, policy string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0o600))
+}
+
+func writeBundle(t *testing.T, path string, policies map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, policy := range policies {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(policy))}))
+		_, err := tw.Write([]byte(policy))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+}
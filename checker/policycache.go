@@ -0,0 +1,103 @@
+package checker
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// PolicyCache holds compiled repository policies, so unchanged policies can be revalidated instead of refetched.
+// It is bounded by size, evicting the least recently used policy, and entries expire after a TTL.
+type PolicyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cachedPolicy struct {
+	*Policy
+	etag    string
+	expires time.Time
+}
+
+// reuse returns the compiled policy if its blob is unchanged.
+func (c *cachedPolicy) reuse(sha string) *Policy {
+	if c == nil || c.SHA != sha {
+		return nil
+	}
+	return c.Policy
+}
+
+func NewPolicyCache(size int, ttl time.Duration) *PolicyCache {
+	return &PolicyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached policy for a repository, or nil if there is none.
+func (c *PolicyCache) get(repo string) *cachedPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[repo]
+	if !ok {
+		return nil
+	}
+	cached := e.Value.(*cachedPolicy)
+	if time.Now().After(cached.expires) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return cached
+}
+
+// put caches a policy, identified by the ETag it was fetched with.
+func (c *PolicyCache) put(policy *Policy, etag string) {
+	if etag == "" {
+		// Without an ETag, the policy can't be revalidated
+		return
+	}
+	cached := &cachedPolicy{
+		Policy:  policy,
+		etag:    etag,
+		expires: time.Now().Add(c.ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[policy.Repository]; ok {
+		e.Value = cached
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[policy.Repository] = c.lru.PushFront(cached)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops any cached policy for a repository.
+func (c *PolicyCache) Invalidate(repo string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[repo]; ok {
+		c.remove(e)
+	}
+}
+
+// Len returns the number of cached policies.
+func (c *PolicyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *PolicyCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cachedPolicy).Repository)
+}
@@ -0,0 +1,50 @@
+package checker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("evicts least recently used", func(t *testing.T) {
+		t.Parallel()
+		c := NewPolicyCache(2, time.Hour)
+		c.put(&Policy{Repository: "thepwagner/foo", SHA: "foo"}, `"foo"`)
+		c.put(&Policy{Repository: "thepwagner/bar", SHA: "bar"}, `"bar"`)
+		assert.NotNil(t, c.get("thepwagner/foo"))
+
+		c.put(&Policy{Repository: "thepwagner/baz", SHA: "baz"}, `"baz"`)
+		assert.Equal(t, 2, c.Len())
+		assert.NotNil(t, c.get("thepwagner/foo"))
+		assert.Nil(t, c.get("thepwagner/bar"))
+		assert.Equal(t, `"baz"`, c.get("thepwagner/baz").etag)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		t.Parallel()
+		c := NewPolicyCache(2, time.Millisecond)
+		c.put(&Policy{Repository: "thepwagner/foo", SHA: "foo"}, `"foo"`)
+		time.Sleep(5 * time.Millisecond)
+		assert.Nil(t, c.get("thepwagner/foo"))
+		assert.Equal(t, 0, c.Len())
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		t.Parallel()
+		c := NewPolicyCache(2, time.Hour)
+		c.put(&Policy{Repository: "thepwagner/foo", SHA: "foo"}, `"foo"`)
+		c.Invalidate("thepwagner/foo")
+		assert.Nil(t, c.get("thepwagner/foo"))
+	})
+
+	t.Run("requires etag", func(t *testing.T) {
+		t.Parallel()
+		c := NewPolicyCache(2, time.Hour)
+		c.put(&Policy{Repository: "thepwagner/foo", SHA: "foo"}, "")
+		assert.Nil(t, c.get("thepwagner/foo"))
+	})
+}
@@ -5,29 +5,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"time"
 
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
 )
 
 // Rego is an api.TokenChecker that evaluates a Rego policy.
+// Only the rules that decide requests are evaluated, so other rules in the package can't fail a request.
 type Rego struct {
-	log   *slog.Logger
-	query rego.PreparedEvalQuery
+	log         *slog.Logger
+	allow       rego.PreparedEvalQuery
+	grant       rego.PreparedEvalQuery
+	denyReasons rego.PreparedEvalQuery
 }
 
 func NewRego(ctx context.Context, log *slog.Logger, policy string) (*Rego, error) {
-	query, err := rego.New(
-		rego.Query("data.tokens.allow"),
-		rego.Module("tokens.rego", policy),
-	).PrepareForEval(ctx)
+	compiler, err := ast.CompileModules(map[string]string{"tokens.rego": policy})
 	if err != nil {
-		return nil, fmt.Errorf("preparing query: %w", err)
+		return nil, fmt.Errorf("compiling policy: %w", err)
 	}
-	return &Rego{
-		log:   log,
-		query: query,
-	}, nil
+	r := &Rego{log: log}
+	for query, prepared := range map[string]*rego.PreparedEvalQuery{
+		"data.tokens.allow":        &r.allow,
+		"data.tokens.grant":        &r.grant,
+		"data.tokens.deny_reasons": &r.denyReasons,
+	} {
+		*prepared, err = rego.New(rego.Query(query), rego.Compiler(compiler)).PrepareForEval(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("preparing query: %w", err)
+		}
+	}
+	return r, nil
 }
 
 var _ api.TokenChecker = (*Rego)(nil)
@@ -38,7 +49,7 @@ type regoInput struct {
 	Permissions  map[string]string `json:"permissions"`
 }
 
-func (r Rego) Check(ctx context.Context, claims api.Claims, req *api.TokenRequest) (bool, error) {
+func (r Rego) Check(ctx context.Context, claims api.Claims, req *api.TokenRequest) (*api.Decision, error) {
 	ri := regoInput{
 		Claims:       claims,
 		Repositories: req.Repositories,
@@ -47,9 +58,95 @@ func (r Rego) Check(ctx context.Context, claims api.Claims, req *api.TokenReques
 	riJSON, _ := json.Marshal(ri)
 	r.log.Info("evaluating policy", "input", string(riJSON))
 
-	rs, err := r.query.Eval(ctx, rego.EvalInput(ri))
+	start := time.Now()
+	decision, err := r.check(ctx, ri, req)
+	metrics.PolicyEvalDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+	return decision, err
+}
+
+func (r Rego) check(ctx context.Context, ri regoInput, req *api.TokenRequest) (*api.Decision, error) {
+	allow, err := eval(ctx, r.allow, ri)
+	if err != nil {
+		return nil, err
+	}
+	if allowed, _ := allow.(bool); allowed {
+		return &api.Decision{
+			Allowed:  true,
+			Policies: []api.PolicyDecision{{Allowed: true}},
+		}, nil
+	}
+
+	// Policies that don't allow the request as-is may grant part of it:
+	grantRaw, err := eval(ctx, r.grant, ri)
+	if err != nil {
+		return nil, err
+	}
+	if grantRaw != nil {
+		granted, err := regoGrant(grantRaw, req)
+		if err != nil {
+			return nil, err
+		}
+		if granted.Valid() == nil {
+			r.log.Info("policy granted request", "repositories", granted.Repositories, "permissions", granted.Permissions)
+			return &api.Decision{
+				Allowed:  true,
+				Granted:  granted,
+				Policies: []api.PolicyDecision{{Allowed: true, Granted: granted}},
+			}, nil
+		}
+	}
+
+	denyReasons, err := eval(ctx, r.denyReasons, ri)
+	if err != nil {
+		return nil, err
+	}
+	reasons := regoStrings(denyReasons)
+	return &api.Decision{
+		Reasons:  reasons,
+		Policies: []api.PolicyDecision{{Reasons: reasons}},
+	}, nil
+}
+
+// eval evaluates a rule of the policy, returning nil if it is undefined.
+func eval(ctx context.Context, query rego.PreparedEvalQuery, ri regoInput) (interface{}, error) {
+	rs, err := query.Eval(ctx, rego.EvalInput(ri))
 	if err != nil {
-		return false, fmt.Errorf("evaluating query: %w", err)
+		return nil, fmt.Errorf("evaluating query: %w", err)
+	}
+	if len(rs) != 1 || len(rs[0].Expressions) != 1 {
+		return nil, nil
+	}
+	return rs[0].Expressions[0].Value, nil
+}
+
+// regoGrant intersects the `grant` defined by a policy with the request.
+func regoGrant(v interface{}, req *api.TokenRequest) (*api.TokenRequest, error) {
+	grantJSON, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling grant: %w", err)
+	}
+	var grant api.TokenRequest
+	if err := json.Unmarshal(grantJSON, &grant); err != nil {
+		return nil, fmt.Errorf("invalid grant: %w", err)
+	}
+	granted := req.Intersect(grant)
+	return &granted, nil
+}
+
+// regoStrings converts a Rego string or set/array of strings to a slice.
+func regoStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	default:
+		return nil
 	}
-	return rs.Allowed(), nil
 }
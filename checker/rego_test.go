@@ -89,19 +89,152 @@ func TestRego(t *testing.T) {
 			require.NoError(t, err)
 
 			for _, allow := range tc.expectedAllow {
-				ok, err := r.Check(ctx, tc.claims, allow)
+				dec, err := r.Check(ctx, tc.claims, allow)
 				require.NoError(t, err)
-				assert.True(t, ok)
+				assert.True(t, dec.Allowed)
 			}
 			for _, deny := range tc.expectedDeny {
-				ok, err := r.Check(ctx, tc.claims, deny)
+				dec, err := r.Check(ctx, tc.claims, deny)
 				require.NoError(t, err)
-				assert.False(t, ok)
+				assert.False(t, dec.Allowed)
 			}
 		})
 	}
 }
 
+func TestRego_DenyReasons(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r, err := checker.NewRego(ctx, slog.Default(), `
+		package tokens
+		default allow = false
+		allow = true {
+			count(deny_reasons) == 0
+		}
+		deny_reasons["contents:write is not allowed"] {
+			input.permissions.contents == "write"
+		}
+		deny_reasons["public repositories are not allowed"] {
+			input.claims.repository_visibility == "public"
+		}
+	`)
+	require.NoError(t, err)
+
+	dec, err := r.Check(ctx, actionClaims, readContents)
+	require.NoError(t, err)
+	assert.True(t, dec.Allowed)
+	assert.Empty(t, dec.Reasons)
+
+	dec, err = r.Check(ctx, actionClaims, writeContents)
+	require.NoError(t, err)
+	assert.False(t, dec.Allowed)
+	assert.Equal(t, []string{"contents:write is not allowed"}, dec.Reasons)
+
+	publicClaims := api.Claims{"repository_visibility": "public"}
+	dec, err = r.Check(ctx, publicClaims, writeContents)
+	require.NoError(t, err)
+	assert.False(t, dec.Allowed)
+	assert.Equal(t, []string{"contents:write is not allowed", "public repositories are not allowed"}, dec.Reasons)
+}
+
+func TestRego_UnrelatedRules(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	// Rules that aren't part of the decision aren't evaluated, even if they conflict:
+	r, err := checker.NewRego(ctx, slog.Default(), `
+		package tokens
+		level = "low" {
+			input.permissions.contents == "read"
+		}
+		level = "high" {
+			input.permissions.contents == "read"
+		}
+		allow {
+			input.permissions.contents == "read"
+		}
+	`)
+	require.NoError(t, err)
+
+	dec, err := r.Check(ctx, actionClaims, readContents)
+	require.NoError(t, err)
+	assert.True(t, dec.Allowed)
+
+	// Undefined grant and deny_reasons are empty:
+	dec, err = r.Check(ctx, actionClaims, writeContents)
+	require.NoError(t, err)
+	assert.False(t, dec.Allowed)
+	assert.Nil(t, dec.Granted)
+	assert.Empty(t, dec.Reasons)
+}
+
+func TestRego_Grant(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r, err := checker.NewRego(ctx, slog.Default(), `
+		package tokens
+		grant = {
+			"permissions": {"contents": "read", "issues": "write"},
+			"repositories": ["thepwagner/foo", "thepwagner/bar"],
+		} {
+			input.claims.repository_owner == "thepwagner"
+		}
+	`)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		req      *api.TokenRequest
+		expected *api.TokenRequest
+	}{
+		"downscoped permission": {
+			req: &api.TokenRequest{
+				Repositories: []string{"thepwagner/foo"},
+				Permissions:  map[string]string{"contents": "write", "issues": "read"},
+			},
+			expected: &api.TokenRequest{
+				Repositories: []string{"thepwagner/foo"},
+				Permissions:  map[string]string{"contents": "read", "issues": "read"},
+			},
+		},
+		"dropped permission and repository": {
+			req: &api.TokenRequest{
+				Repositories: []string{"thepwagner/foo", "thepwagner/baz"},
+				Permissions:  map[string]string{"contents": "read", "organization_projects": "write"},
+			},
+			expected: &api.TokenRequest{
+				Repositories: []string{"thepwagner/foo"},
+				Permissions:  map[string]string{"contents": "read"},
+			},
+		},
+		"no common permissions": {
+			req: &api.TokenRequest{
+				Repositories: []string{"thepwagner/foo"},
+				Permissions:  map[string]string{"organization_projects": "write"},
+			},
+		},
+		"no common repositories": {
+			req: &api.TokenRequest{
+				Repositories: []string{"thepwagner/baz"},
+				Permissions:  map[string]string{"contents": "read"},
+			},
+		},
+	}
+	for label, tc := range cases {
+		tc := tc
+		t.Run(label, func(t *testing.T) {
+			t.Parallel()
+			dec, err := r.Check(ctx, actionClaims, tc.req)
+			require.NoError(t, err)
+			if tc.expected == nil {
+				assert.False(t, dec.Allowed)
+				assert.Nil(t, dec.Granted)
+				return
+			}
+			assert.True(t, dec.Allowed)
+			assert.Equal(t, tc.expected, dec.Granted)
+		})
+	}
+}
+
 var (
 	actionClaims = api.Claims{
 		"sub":                   "repo:thepwagner/github-token-action:ref:refs/heads/main",
@@ -5,23 +5,52 @@ import (
 	"fmt"
 	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/thepwagner/github-token-factory-oidc/api"
-	"github.com/thepwagner/github-token-factory-oidc/github"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
 	"golang.org/x/sync/errgroup"
 )
 
+// PolicySource loads the policies of repositories.
+type PolicySource interface {
+	// Policy returns the policy of a repository, or nil if it doesn't have one.
+	Policy(ctx context.Context, repo string) (*Policy, error)
+}
+
+// Policy is a Rego policy loaded for a repository.
+type Policy struct {
+	Repository string
+	SHA        string
+	Rego       *Rego
+}
+
+func (p Policy) check(ctx context.Context, claims api.Claims, req *api.TokenRequest) (*api.PolicyDecision, error) {
+	decision, err := p.Rego.Check(ctx, claims, req)
+	if err != nil {
+		return nil, err
+	}
+	return &api.PolicyDecision{
+		Repository: p.Repository,
+		SHA:        p.SHA,
+		Allowed:    decision.Allowed,
+		Reasons:    decision.Reasons,
+		Granted:    decision.Granted,
+	}, nil
+}
+
+// RepoRego is an api.TokenChecker that layers the policies of the owner and repositories in a request.
 type RepoRego struct {
 	log       *slog.Logger
-	github    *github.Clients
+	source    PolicySource
 	ownerRepo string
 	everyRepo bool
 }
 
-func NewRepoRego(log *slog.Logger, github *github.Clients, ownerRepo string, everyRepo bool) *RepoRego {
+func NewRepoRego(log *slog.Logger, source PolicySource, ownerRepo string, everyRepo bool) *RepoRego {
 	return &RepoRego{
 		log:       log.With("logger", "auth.RepoRego"),
-		github:    github,
+		source:    source,
 		ownerRepo: ownerRepo,
 		everyRepo: everyRepo,
 	}
@@ -29,49 +58,91 @@ func NewRepoRego(log *slog.Logger, github *github.Clients, ownerRepo string, eve
 
 var _ api.TokenChecker = (*RepoRego)(nil)
 
-func (r RepoRego) Check(ctx context.Context, claims api.Claims, req *api.TokenRequest) (bool, error) {
+func (r RepoRego) Check(ctx context.Context, claims api.Claims, req *api.TokenRequest) (*api.Decision, error) {
+	var decision api.Decision
+
 	// The token may be approved by the global "owner" policy
-	if ownerOk, err := r.checkOwnerPolicy(ctx, claims, req); err != nil {
-		return false, err
-	} else if ownerOk {
-		return true, nil
+	ownerDecision, err := r.checkOwnerPolicy(ctx, claims, req)
+	if err != nil {
+		return nil, err
+	} else if ownerDecision != nil {
+		decision.Policies = append(decision.Policies, *ownerDecision)
+		if ownerDecision.Allowed {
+			decision.Allowed = true
+			decision.Granted = ownerDecision.Granted
+			return &decision, nil
+		}
 	}
 
 	// For permissions that affect the owner (not individiual repos), don't listen to repositories
 	if req.OwnerPermissions() {
-		return false, nil
+		if ownerDecision != nil {
+			decision.Reasons = ownerDecision.Reasons
+		}
+		return &decision, nil
 	}
 
-	return r.checkRepoPolicies(ctx, claims, req)
+	repoDecisions, err := r.checkRepoPolicies(ctx, claims, req)
+	if err != nil {
+		return nil, err
+	}
+	decision.Policies = append(decision.Policies, repoDecisions...)
+	decision.Allowed = len(repoDecisions) > 0
+	for _, rd := range repoDecisions {
+		decision.Allowed = decision.Allowed && rd.Allowed
+		// Each repository may narrow the grant further:
+		if rd.Granted == nil {
+			continue
+		} else if decision.Granted == nil {
+			decision.Granted = rd.Granted
+		} else {
+			granted := decision.Granted.Intersect(*rd.Granted)
+			decision.Granted = &granted
+		}
+	}
+	if decision.Allowed && decision.Granted != nil && decision.Granted.Valid() != nil {
+		decision.Allowed = false
+		decision.Reasons = append(decision.Reasons, "repository policies granted no common access")
+	}
+	if !decision.Allowed {
+		decision.Granted = nil
+		for _, pd := range decision.Policies {
+			decision.Reasons = append(decision.Reasons, pd.Reasons...)
+		}
+	}
+	return &decision, nil
 }
 
-func (r RepoRego) checkOwnerPolicy(ctx context.Context, claims api.Claims, req *api.TokenRequest) (bool, error) {
+// checkOwnerPolicy evaluates the owner policy, returning nil if there is none.
+func (r RepoRego) checkOwnerPolicy(ctx context.Context, claims api.Claims, req *api.TokenRequest) (*api.PolicyDecision, error) {
 	if r.ownerRepo == "" {
 		// No owner policy is configured
-		return false, nil
+		return nil, nil
 	}
 
 	ownerRepo := r.resolveOwnerRepo(req)
-	rego, err := r.fetchRepoPolicies(ctx, ownerRepo)
+	policies, err := r.fetchRepoPolicies(ctx, ownerRepo)
 	if err != nil {
-		return false, fmt.Errorf("fetching owner policy: %w", err)
+		return nil, fmt.Errorf("fetching owner policy: %w", err)
 	}
-	if len(rego) == 0 {
+	if len(policies) == 0 {
 		// No policy found in the configured repository
-		return false, nil
+		return nil, nil
 	}
 
-	res, err := rego[0].Check(ctx, claims, req)
+	res, err := policies[0].check(ctx, claims, req)
 	if err != nil {
-		return false, fmt.Errorf("checking owner policy: %w", err)
+		return nil, fmt.Errorf("checking owner policy: %w", err)
 	}
-	r.log.Info("evaluated owner policy", "ok", res, "owner_repo", ownerRepo)
+	res.Owner = true
+	r.log.Info("evaluated owner policy", "ok", res.Allowed, "owner_repo", ownerRepo, "policy_sha", res.SHA, "reasons", res.Reasons)
 	return res, nil
 }
 
-func (r RepoRego) checkRepoPolicies(ctx context.Context, claims api.Claims, req *api.TokenRequest) (bool, error) {
+// checkRepoPolicies evaluates the policy of every repository in the request, until one rejects it.
+func (r RepoRego) checkRepoPolicies(ctx context.Context, claims api.Claims, req *api.TokenRequest) ([]api.PolicyDecision, error) {
 	if !r.everyRepo {
-		return false, nil
+		return nil, nil
 	}
 
 	ownerRepo := r.resolveOwnerRepo(req)
@@ -80,7 +151,7 @@ func (r RepoRego) checkRepoPolicies(ctx context.Context, claims api.Claims, req
 	for _, repo := range req.Repositories {
 		// We know the owner repo will fail, ABORT!
 		if repo == ownerRepo {
-			return false, nil
+			return nil, nil
 		}
 		if _, ok := uniq[repo]; ok {
 			continue
@@ -89,27 +160,27 @@ func (r RepoRego) checkRepoPolicies(ctx context.Context, claims api.Claims, req
 		toFetch = append(toFetch, repo)
 	}
 
-	regos, err := r.fetchRepoPolicies(ctx, toFetch...)
+	policies, err := r.fetchRepoPolicies(ctx, toFetch...)
 	if err != nil {
-		return false, fmt.Errorf("fetching repository policies: %w", err)
+		return nil, fmt.Errorf("fetching repository policies: %w", err)
 	}
-	if len(regos) != len(toFetch) {
-		return false, fmt.Errorf("expected %d repo policies, got %d", len(toFetch), len(regos))
+	if len(policies) != len(toFetch) {
+		return nil, fmt.Errorf("expected %d repo policies, got %d", len(toFetch), len(policies))
 	}
-	for _, rego := range regos {
-		res, err := rego.Check(ctx, claims, req)
+	decisions := make([]api.PolicyDecision, 0, len(policies))
+	for _, policy := range policies {
+		res, err := policy.check(ctx, claims, req)
 		if err != nil {
-			return false, fmt.Errorf("checking repository policy: %w", err)
+			return nil, fmt.Errorf("checking repository policy: %w", err)
 		}
-		r.log.Info("evaluated repo policy", "ok", res)
-		if !res {
+		r.log.Info("evaluated repo policy", "ok", res.Allowed, "repository", res.Repository, "policy_sha", res.SHA, "reasons", res.Reasons)
+		decisions = append(decisions, *res)
+		if !res.Allowed {
 			// Must by accepted by every policy, so the first rejection is terminal:
-			return false, nil
+			break
 		}
 	}
-
-	// The request has been approved by all repository policies
-	return true, nil
+	return decisions, nil
 }
 
 func (r RepoRego) resolveOwnerRepo(req *api.TokenRequest) string {
@@ -122,9 +193,9 @@ func (r RepoRego) resolveOwnerRepo(req *api.TokenRequest) string {
 	return fmt.Sprintf("%s/%s", req.Owner(), r.ownerRepo)
 }
 
-func (r RepoRego) fetchRepoPolicies(ctx context.Context, repos ...string) ([]*Rego, error) {
+func (r RepoRego) fetchRepoPolicies(ctx context.Context, repos ...string) ([]*Policy, error) {
 	eg, ctx := errgroup.WithContext(ctx)
-	regos := make(chan *Rego, 1)
+	regos := make(chan *Policy, 1)
 	for _, repo := range repos {
 		repo := repo
 		eg.Go(r.fetchRepoPolicy(ctx, repo, regos))
@@ -135,7 +206,7 @@ func (r RepoRego) fetchRepoPolicies(ctx context.Context, repos ...string) ([]*Re
 	}()
 
 	// Collect results:
-	res := make([]*Rego, 0, len(repos))
+	res := make([]*Policy, 0, len(repos))
 	for c := range regos {
 		res = append(res, c)
 	}
@@ -145,36 +216,17 @@ func (r RepoRego) fetchRepoPolicies(ctx context.Context, repos ...string) ([]*Re
 	return res, nil
 }
 
-func (r RepoRego) fetchRepoPolicy(ctx context.Context, repo string, res chan *Rego) func() error {
+func (r RepoRego) fetchRepoPolicy(ctx context.Context, repo string, res chan *Policy) func() error {
 	return func() error {
-		repoParts := strings.Split(repo, "/")
-		if len(repoParts) != 2 {
-			return fmt.Errorf("invalid repo: %s", repo)
-		}
-
-		client, err := r.github.AppClient(ctx, repoParts[0])
-		if err != nil {
-			return fmt.Errorf("getting client for %s: %w", repo, err)
-		}
-		fc, _, _, err := client.Repositories.GetContents(ctx, repoParts[0], repoParts[1], ".github/tokens.rego", nil)
-		if err != nil {
-			if strings.Contains(strings.ToLower(err.Error()), "404 not found") {
-				return nil
-			}
-			return fmt.Errorf("fetching repo policy: %w", err)
-		}
-
-		r.log.Info("fetched policy", "repository", repo, "sha", fc.GetSHA())
-		policyRaw, err := fc.GetContent()
+		start := time.Now()
+		policy, err := r.source.Policy(ctx, repo)
+		metrics.PolicyFetchDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
 		if err != nil {
-			return fmt.Errorf("fetching repo policy content: %w", err)
+			return err
 		}
-
-		rego, err := NewRego(ctx, r.log, policyRaw)
-		if err != nil {
-			return fmt.Errorf("parsing repo policy: %w", err)
+		if policy != nil {
+			res <- policy
 		}
-		res <- rego
 		return nil
 	}
 }
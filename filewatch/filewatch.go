@@ -0,0 +1,59 @@
+// Package filewatch reloads configuration files when they change.
+package filewatch
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay debounces bursts of filesystem events into a single reload.
+const reloadDelay = 100 * time.Millisecond
+
+// Dir returns a watcher of the directory containing path.
+// Files are watched through their directory, since they're usually replaced rather than written in place:
+// by a rename, or by Kubernetes mounts swapping a `..data` symlink.
+func Dir(path string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, fmt.Errorf("watching %q: %w", path, err)
+	}
+	return watcher, nil
+}
+
+// Run calls reload after each burst of events from the watcher, until the context is cancelled, then closes the watcher.
+// Any event triggers a reload, reload should keep using the previous value if the new one is broken.
+// Errors from the watcher are passed to onError, if set.
+func Run(ctx context.Context, watcher *fsnotify.Watcher, reload func(), onError func(error)) {
+	defer watcher.Close()
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if onError != nil {
+				onError(err)
+			}
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			timer.Reset(reloadDelay)
+		case <-timer.C:
+			reload()
+		}
+	}
+}
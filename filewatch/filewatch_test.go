@@ -0,0 +1,56 @@
+package filewatch_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/filewatch"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	path := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0o600))
+
+	watcher, err := filewatch.Dir(path)
+	require.NoError(t, err)
+	var reloads atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		filewatch.Run(ctx, watcher, func() { reloads.Add(1) }, nil)
+	}()
+
+	// A burst of changes is reloaded once:
+	for i := 0; i < 5; i++ {
+		require.NoError(t, os.WriteFile(path, []byte("v2"), 0o600))
+	}
+	require.Eventually(t, func() bool { return reloads.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Replacing the file by a rename is reloaded too:
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("v3"), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+	require.Eventually(t, func() bool { return reloads.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+	assert.EqualValues(t, 2, reloads.Load())
+}
+
+func TestDir_Missing(t *testing.T) {
+	t.Parallel()
+	_, err := filewatch.Dir(filepath.Join(t.TempDir(), "missing", "config"))
+	assert.Error(t, err)
+}
@@ -2,61 +2,137 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	ghinstallation "github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v62/github"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
 )
 
 type Config struct {
-	AppID          int64  `mapstructure:"app_id"`
+	AppID int64 `mapstructure:"app_id"`
+	// The app's private key is loaded from exactly one of:
+	// a PEM file, reloaded when it changes;
 	PrivateKeyPath string `mapstructure:"private_key_path"`
+	// inline PEM;
+	PrivateKey string `mapstructure:"private_key"`
+	// or the name of an environment variable holding base64 encoded PEM.
+	PrivateKeyEnv string `mapstructure:"private_key_env"`
+	// More keys of the app, so keys can be rotated. Keys are listed newest first, starting with the key above if it's set.
+	PrivateKeys []KeyConfig `mapstructure:"private_keys"`
+	// How long older keys are used after GitHub rejects the newest key, before it's tried again. Defaults to 5m.
+	KeyRetryInterval time.Duration `mapstructure:"key_retry_interval"`
+	// How often health checks sign with keys held outside the server, like remote signers. Defaults to 1m.
+	KeyProbeInterval time.Duration `mapstructure:"key_probe_interval"`
+	// For GitHub Enterprise Server, the API and upload URLs of the instance. Defaults to github.com.
+	BaseURL   string `mapstructure:"base_url"`
+	UploadURL string `mapstructure:"upload_url"`
+	// Secret of the app's webhook, which must be set to receive webhooks.
+	WebhookSecret string `mapstructure:"webhook_secret"`
+}
+
+// newClient creates a client for the configured GitHub instance.
+func (c Config) newClient(tr http.RoundTripper) (*github.Client, error) {
+	client := github.NewClient(&http.Client{Transport: tr})
+	if c.BaseURL == "" {
+		return client, nil
+	}
+	uploadURL := c.UploadURL
+	if uploadURL == "" {
+		uploadURL = c.BaseURL
+	}
+	client, err := client.WithEnterpriseURLs(c.BaseURL, uploadURL)
+	if err != nil {
+		return nil, fmt.Errorf("configuring enterprise URLs: %w", err)
+	}
+	return client, nil
+}
+
+// host returns the web host of the configured GitHub instance, e.g. `github.com` for `https://api.github.com/`.
+func (c Config) host() string {
+	if c.BaseURL == "" {
+		return "github.com"
+	}
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Host, "api.")
 }
 
 type Clients struct {
+	log        *slog.Logger
 	transport  http.RoundTripper
 	configs    map[string]Config
-	clients    sync.Map
-	appClients sync.Map
+	keys       map[string]*appKeys
+	ttl        time.Duration
+	clients    clientCache
+	appClients clientCache
 }
 
-func NewClients(transport http.RoundTripper, configs map[string]Config) *Clients {
-	return &Clients{
-		transport: transport,
-		configs:   configs,
+// NewClients creates Clients for the configured apps, loading their private keys.
+// Cached clients expire after ttl, or never if it is 0.
+func NewClients(ctx context.Context, log *slog.Logger, transport http.RoundTripper, configs map[string]Config, ttl time.Duration) (*Clients, error) {
+	log = log.With("logger", "github.Clients")
+	keys := make(map[string]*appKeys, len(configs))
+	for owner, cfg := range configs {
+		key, err := loadAppKeys(ctx, log.With("owner", owner), &http.Client{Transport: transport}, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("loading private key for owner %q: %w", owner, err)
+		}
+		keys[owner] = key
 	}
+	return &Clients{
+		log:        log,
+		transport:  transport,
+		configs:    configs,
+		keys:       keys,
+		ttl:        ttl,
+		clients:    clientCache{kind: "app"},
+		appClients: clientCache{kind: "installation"},
+	}, nil
 }
 
 type Client struct {
 	*github.Client
 	installationID int64
+	expires        time.Time
 }
 
 func (c *Clients) Client(ctx context.Context, owner string) (*Client, error) {
-	if client, ok := c.clients.Load(owner); ok {
-		return client.(*Client), nil
+	if client, ok := c.clients.load(owner); ok {
+		return client, nil
 	}
 
-	// Load owner's config, fallback to default config
-	cfg, ok := c.configs[owner]
+	name, ok := c.configName(owner)
 	if !ok {
-		cfg, ok = c.configs["*"]
-		if !ok {
-			return nil, fmt.Errorf("no configuration for repository owner %q", owner)
-		}
+		return nil, fmt.Errorf("no configuration for repository owner %q", owner)
 	}
-	tr, err := ghinstallation.NewAppsTransportKeyFromFile(c.transport, cfg.AppID, cfg.PrivateKeyPath)
+	cfg := c.configs[name]
+	keys := c.keys[name]
+	tr, err := ghinstallation.NewAppsTransportWithOptions(keys.transport(c.transport), cfg.AppID, ghinstallation.WithSigner(keys))
 	if err != nil {
 		return nil, fmt.Errorf("creating app transport: %w", err)
 	}
-	client := github.NewClient(&http.Client{Transport: tr})
+	client, err := cfg.newClient(tr)
+	if err != nil {
+		return nil, err
+	}
+	// The installation transport mints tokens from the same instance:
+	tr.BaseURL = strings.TrimSuffix(client.BaseURL.String(), "/")
 
 	// Assume the owner is an organization, fallback to user
 	installation, res, err := client.Apps.FindOrganizationInstallation(ctx, owner)
 	if err != nil {
-		if res.StatusCode != http.StatusNotFound {
+		if res == nil || res.StatusCode != http.StatusNotFound {
 			return nil, fmt.Errorf("finding org installation: %w", err)
 		}
 
@@ -66,17 +142,16 @@ func (c *Clients) Client(ctx context.Context, owner string) (*Client, error) {
 		}
 	}
 
-	entry := &Client{
+	return c.clients.store(owner, &Client{
 		Client:         client,
 		installationID: installation.GetID(),
-	}
-	c.clients.Store(owner, entry)
-	return entry, nil
+		expires:        c.expiry(),
+	}), nil
 }
 
 func (c *Clients) AppClient(ctx context.Context, owner string) (*Client, error) {
-	if client, ok := c.appClients.Load(owner); ok {
-		return client.(*Client), nil
+	if client, ok := c.appClients.load(owner); ok {
+		return client, nil
 	}
 
 	client, err := c.Client(ctx, owner)
@@ -85,11 +160,175 @@ func (c *Clients) AppClient(ctx context.Context, owner string) (*Client, error)
 	}
 	tr := client.Client.Client().Transport.(*ghinstallation.AppsTransport)
 	transport := ghinstallation.NewFromAppsTransport(tr, client.installationID)
+	cfg, ok := c.config(owner)
+	if !ok {
+		return nil, fmt.Errorf("no configuration for repository owner %q", owner)
+	}
+	installationClient, err := cfg.newClient(transport)
+	if err != nil {
+		return nil, err
+	}
 
-	entry := &Client{
-		Client:         github.NewClient(&http.Client{Transport: transport}),
+	return c.appClients.store(owner, &Client{
+		Client:         installationClient,
 		installationID: client.installationID,
+		expires:        client.expires,
+	}), nil
+}
+
+// WithClient calls fn with the owner's app client, retrying once if its cached installation is stale.
+func (c *Clients) WithClient(ctx context.Context, owner string, fn func(*Client) error) error {
+	return c.withClient(ctx, owner, c.Client, fn)
+}
+
+// WithAppClient calls fn with the owner's installation client, retrying once if its cached installation is stale.
+func (c *Clients) WithAppClient(ctx context.Context, owner string, fn func(*Client) error) error {
+	return c.withClient(ctx, owner, c.AppClient, fn)
+}
+
+func (c *Clients) withClient(ctx context.Context, owner string, get func(context.Context, string) (*Client, error), fn func(*Client) error) error {
+	// Installations that were just found aren't stale, so their errors aren't retried:
+	_, cached := c.clients.load(owner)
+	if !cached {
+		_, cached = c.appClients.load(owner)
+	}
+	client, err := get(ctx, owner)
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !cached || !staleInstallation(err) {
+		return err
+	}
+
+	// The app may have been reinstalled since the installation was cached:
+	c.log.Warn("evicting stale installation", "owner", owner, slog.String("err", err.Error()))
+	c.Evict(owner)
+	if client, err = get(ctx, owner); err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+// Evict drops the cached clients of an owner, so its installation is found again.
+func (c *Clients) Evict(owner string) {
+	c.clients.evict(owner)
+	c.appClients.evict(owner)
+}
+
+func (c *Clients) expiry() time.Time {
+	if c.ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.ttl)
+}
+
+// staleInstallation returns true if GitHub rejected a request because an installation was removed,
+// so clients for the installation should be evicted.
+func staleInstallation(err error) bool {
+	var status int
+	var errResp *github.ErrorResponse
+	var httpErr *ghinstallation.HTTPError
+	switch {
+	case errors.As(err, &errResp) && errResp.Response != nil:
+		status = errResp.Response.StatusCode
+	case errors.As(err, &httpErr) && httpErr.Response != nil:
+		status = httpErr.Response.StatusCode
+	}
+	return status == http.StatusNotFound || status == http.StatusUnauthorized
+}
+
+// clientCache caches clients by owner, until they expire.
+type clientCache struct {
+	entries sync.Map
+	// kind labels the cached clients in metrics.
+	kind string
+}
+
+func (cc *clientCache) load(owner string) (*Client, bool) {
+	v, ok := cc.entries.Load(owner)
+	if !ok {
+		return nil, false
+	}
+	client := v.(*Client)
+	if client.expires.IsZero() || time.Now().Before(client.expires) {
+		return client, true
+	}
+	if cc.entries.CompareAndDelete(owner, client) {
+		metrics.GitHubClients.WithLabelValues(cc.kind).Dec()
+	}
+	return nil, false
+}
+
+// store caches a client, unless a client for the owner was already cached.
+func (cc *clientCache) store(owner string, client *Client) *Client {
+	if existing, loaded := cc.entries.LoadOrStore(owner, client); loaded {
+		return existing.(*Client)
+	}
+	metrics.GitHubClients.WithLabelValues(cc.kind).Inc()
+	return client
+}
+
+func (cc *clientCache) evict(owner string) {
+	if _, loaded := cc.entries.LoadAndDelete(owner); loaded {
+		metrics.GitHubClients.WithLabelValues(cc.kind).Dec()
+	}
+}
+
+// TokenClient returns a client authenticated by an installation token, for the instance the owner is configured on.
+// An empty owner is the default instance: the `*` config's, or github.com.
+func (c *Clients) TokenClient(owner, token string) (*github.Client, error) {
+	cfg, ok := c.config(owner)
+	if !ok && owner != "" {
+		return nil, fmt.Errorf("no configuration for repository owner %q", owner)
+	}
+	client, err := cfg.newClient(c.transport)
+	if err != nil {
+		return nil, err
+	}
+	return client.WithAuthToken(token), nil
+}
+
+// config loads the owner's config, falling back to the default config.
+func (c *Clients) config(owner string) (Config, bool) {
+	name, ok := c.configName(owner)
+	return c.configs[name], ok
+}
+
+// configName returns the name of the owner's config, or the default config.
+func (c *Clients) configName(owner string) (string, bool) {
+	if _, ok := c.configs[owner]; ok {
+		return owner, true
+	}
+	_, ok := c.configs["*"]
+	return "*", ok
+}
+
+var (
+	_ api.HealthChecker   = (*Clients)(nil)
+	_ api.GitHubInstances = (*Clients)(nil)
+)
+
+// Configured returns true if the owner has its own config, rather than the default config.
+func (c *Clients) Configured(owner string) bool {
+	_, ok := c.configs[owner]
+	return ok && owner != "*"
+}
+
+// Host returns the web host of the GitHub instance the owner is configured on.
+func (c *Clients) Host(owner string) (string, bool) {
+	cfg, ok := c.config(owner)
+	if !ok {
+		return "", false
+	}
+	return cfg.host(), true
+}
+
+// CheckHealth reports whether each configured app's keys can sign an app JWT.
+func (c *Clients) CheckHealth(ctx context.Context) map[string]error {
+	res := make(map[string]error, len(c.configs))
+	for owner := range c.configs {
+		res["github/"+owner] = c.keys[owner].CheckHealth(ctx)
 	}
-	c.appClients.Store(owner, entry)
-	return entry, nil
+	return res
 }
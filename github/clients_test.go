@@ -0,0 +1,347 @@
+package github_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/github"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
+)
+
+func newClients(t *testing.T, transport http.RoundTripper, configs map[string]github.Config, ttl time.Duration) *github.Clients {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	clients, err := github.NewClients(ctx, slog.Default(), transport, configs, ttl)
+	require.NoError(t, err)
+	return clients
+}
+
+func privateKeyPEM(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func writePrivateKey(t *testing.T) string {
+	t.Helper()
+	path, _ := writePrivateKeyFile(t)
+	return path
+}
+
+func writePrivateKeyFile(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	key, keyPEM := privateKeyPEM(t)
+	path := filepath.Join(t.TempDir(), "app.pem")
+	require.NoError(t, os.WriteFile(path, keyPEM, 0o600))
+	return path, key
+}
+
+// keyID is the fingerprint GitHub displays for a key.
+func keyID(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	fingerprint := sha256.Sum256(der)
+	return "SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:])
+}
+
+func TestNewClients_PrivateKey(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, keyPEM := privateKeyPEM(t)
+	env := fmt.Sprintf("GTFO_TEST_PRIVATE_KEY_%d", time.Now().UnixNano())
+	require.NoError(t, os.Setenv(env, base64.StdEncoding.EncodeToString(keyPEM)))
+	t.Cleanup(func() { _ = os.Unsetenv(env) })
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a key"), 0o600))
+
+	valid := map[string]github.Config{
+		"file":   {AppID: 1, PrivateKeyPath: writePrivateKey(t)},
+		"inline": {AppID: 2, PrivateKey: string(keyPEM)},
+		"env":    {AppID: 3, PrivateKeyEnv: env},
+	}
+	clients, err := github.NewClients(ctx, slog.Default(), http.DefaultTransport, valid, 0)
+	require.NoError(t, err)
+	for owner, err := range clients.CheckHealth(ctx) {
+		assert.NoError(t, err, owner)
+	}
+
+	invalid := map[string]github.Config{
+		"none":     {AppID: 1},
+		"multiple": {AppID: 1, PrivateKey: string(keyPEM), PrivateKeyEnv: env},
+		"garbage":  {AppID: 1, PrivateKeyPath: garbage},
+		"missing":  {AppID: 1, PrivateKeyPath: filepath.Join(t.TempDir(), "missing.pem")},
+		"inline":   {AppID: 1, PrivateKey: "not a key"},
+		"unset":    {AppID: 1, PrivateKeyEnv: env + "_UNSET"},
+		"encoding": {AppID: 1, PrivateKeyEnv: "PATH"},
+	}
+	for owner, cfg := range invalid {
+		_, err := github.NewClients(ctx, slog.Default(), http.DefaultTransport, map[string]github.Config{owner: cfg}, 0)
+		assert.Error(t, err, owner)
+	}
+}
+
+func TestClients_PrivateKeyRotation(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	path, oldKey := writePrivateKeyFile(t)
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {AppID: 23, PrivateKeyPath: path, BaseURL: gh.URL},
+	}, time.Nanosecond)
+	ctx := context.Background()
+
+	// Replace the key, as a mounted secret would be:
+	newKey, newPEM := privateKeyPEM(t)
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, newPEM, 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+	require.Eventually(t, func() bool {
+		if _, err := clients.Client(ctx, "acme"); err != nil {
+			return false
+		}
+		_, err := jwt.Parse(gh.lastJWT.Load().(string), func(*jwt.Token) (interface{}, error) {
+			return &newKey.PublicKey, nil
+		})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.GitHubAppKey.WithLabelValues("23", keyID(t, newKey))))
+	assert.False(t, metrics.GitHubAppKey.DeleteLabelValues("23", keyID(t, oldKey)), "replaced keys are dropped")
+
+	// A broken key keeps the previous one, and is reported as unhealthy:
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0o600))
+	require.Eventually(t, func() bool {
+		return clients.CheckHealth(ctx)["github/acme"] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := clients.Client(ctx, "acme")
+	require.NoError(t, err)
+}
+
+func TestClients_KeyFallback(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	oldKey, oldPEM := privateKeyPEM(t)
+	newKey, newPEM := privateKeyPEM(t)
+	const retryInterval = 200 * time.Millisecond
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {
+			AppID:            24,
+			PrivateKey:       string(newPEM),
+			PrivateKeys:      []github.KeyConfig{{PEM: string(oldPEM)}},
+			KeyRetryInterval: retryInterval,
+			BaseURL:          gh.URL,
+		},
+	}, time.Nanosecond)
+	ctx := context.Background()
+
+	// The new key hasn't been registered with GitHub yet:
+	gh.trustedKey.Store(&oldKey.PublicKey)
+	for i := 0; i < 2; i++ {
+		client, err := clients.Client(ctx, "acme")
+		require.NoError(t, err)
+		_, _, err = client.Apps.CreateInstallationToken(ctx, 1, nil)
+		require.NoError(t, err)
+	}
+	// The new key is only tried once, then the old key is used:
+	assert.Equal(t, int32(3), gh.lookups.Load())
+	for owner, err := range clients.CheckHealth(ctx) {
+		assert.NoError(t, err, owner)
+	}
+	_, err := jwt.Parse(gh.lastJWT.Load().(string), func(*jwt.Token) (interface{}, error) {
+		return &oldKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.GitHubAppKey.WithLabelValues("24", keyID(t, oldKey))))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.GitHubAppKey.WithLabelValues("24", keyID(t, newKey))))
+
+	// Once the new key is registered, it's used again after the retry interval:
+	gh.trustedKey.Store(&newKey.PublicKey)
+	time.Sleep(retryInterval)
+	_, err = clients.Client(ctx, "acme")
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), gh.lookups.Load())
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.GitHubAppKey.WithLabelValues("24", keyID(t, newKey))))
+}
+
+func TestClients_Enterprise(t *testing.T) {
+	t.Parallel()
+
+	var paths []string
+	ghes := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/orgs/acme/installation":
+			_, _ = w.Write([]byte(`{"id": 42}`))
+		case "/api/v3/app/installations/42/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"token": "ghs_installation", "expires_at": "2030-01-01T00:00:00Z"}`))
+		case "/api/v3/installation/token":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer ghes.Close()
+
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {AppID: 1, PrivateKeyPath: writePrivateKey(t), BaseURL: ghes.URL},
+	}, 0)
+	ctx := context.Background()
+	client, err := clients.AppClient(ctx, "acme")
+	require.NoError(t, err)
+	_, _, err = client.Repositories.Get(ctx, "acme", "gtfo")
+	require.NoError(t, err)
+
+	tokenClient, err := clients.TokenClient("acme", "ghs_installation")
+	require.NoError(t, err)
+	_, err = tokenClient.Apps.RevokeInstallationToken(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"GET /api/v3/orgs/acme/installation",
+		"POST /api/v3/app/installations/42/access_tokens",
+		"GET /api/v3/repos/acme/gtfo",
+		"DELETE /api/v3/installation/token",
+	}, paths)
+}
+
+func TestClients_Instances(t *testing.T) {
+	t.Parallel()
+	key := writePrivateKey(t)
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme":  {AppID: 1, PrivateKeyPath: key, BaseURL: "https://github.acme.internal/api/v3/"},
+		"cloud": {AppID: 2, PrivateKeyPath: key, BaseURL: "https://api.cloud.ghe.com/"},
+		"*":     {AppID: 3, PrivateKeyPath: key},
+	}, 0)
+
+	cases := map[string]struct {
+		host       string
+		configured bool
+	}{
+		"acme":       {host: "github.acme.internal", configured: true},
+		"cloud":      {host: "cloud.ghe.com", configured: true},
+		"thepwagner": {host: "github.com"},
+		"*":          {host: "github.com"},
+	}
+	for owner, tc := range cases {
+		host, ok := clients.Host(owner)
+		assert.True(t, ok, owner)
+		assert.Equal(t, tc.host, host, owner)
+		assert.Equal(t, tc.configured, clients.Configured(owner), owner)
+	}
+
+	// Without a default config, other owners aren't served by any instance:
+	clients = newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {AppID: 1, PrivateKeyPath: key, BaseURL: "https://github.acme.internal/api/v3/"},
+	}, 0)
+	_, ok := clients.Host("thepwagner")
+	assert.False(t, ok)
+}
+
+// fakeInstallations serves an app installed to "acme", which can be reinstalled with a new ID.
+type fakeInstallations struct {
+	*httptest.Server
+	installationID atomic.Int64
+	lookups        atomic.Int32
+	lastJWT        atomic.Value
+	// If set, app JWTs not signed by this key are rejected.
+	trustedKey atomic.Pointer[rsa.PublicKey]
+}
+
+// authenticate rejects app JWTs not signed by the trusted key.
+func (f *fakeInstallations) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	trusted := f.trustedKey.Load()
+	if trusted == nil {
+		return true
+	}
+	_, err := jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), func(*jwt.Token) (interface{}, error) {
+		return trusted, nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"message": "A JSON web token could not be decoded"}`))
+		return false
+	}
+	return true
+}
+
+func newFakeInstallations(t *testing.T) *fakeInstallations {
+	t.Helper()
+	f := &fakeInstallations{}
+	f.installationID.Store(1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v3/orgs/acme/installation", func(w http.ResponseWriter, r *http.Request) {
+		f.lookups.Add(1)
+		f.lastJWT.Store(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if !f.authenticate(w, r) {
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"id": %d}`, f.installationID.Load())
+	})
+	mux.HandleFunc("POST /api/v3/app/installations/{id}/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if !f.authenticate(w, r) {
+			return
+		}
+		if r.PathValue("id") != strconv.FormatInt(f.installationID.Load(), 10) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"token": "ghs_installation", "expires_at": "2030-01-01T00:00:00Z"}`))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestClients_TTL(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	ctx := context.Background()
+	configs := map[string]github.Config{
+		"acme": {AppID: 1, PrivateKeyPath: writePrivateKey(t), BaseURL: gh.URL},
+	}
+
+	cached := newClients(t, http.DefaultTransport, configs, time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err := cached.Client(ctx, "acme")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), gh.lookups.Load())
+
+	cached.Evict("acme")
+	_, err := cached.Client(ctx, "acme")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), gh.lookups.Load())
+
+	expiring := newClients(t, http.DefaultTransport, configs, time.Nanosecond)
+	for i := 0; i < 3; i++ {
+		_, err := expiring.Client(ctx, "acme")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(5), gh.lookups.Load())
+}
@@ -2,12 +2,17 @@ package github
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/v62/github"
 	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
@@ -28,7 +33,7 @@ func NewIssuer(log *slog.Logger, tracer trace.Tracer, clients *Clients) *Issuer
 	}
 }
 
-func (g *Issuer) IssueToken(ctx context.Context, req *api.TokenRequest) (string, error) {
+func (g *Issuer) IssueToken(ctx context.Context, req *api.TokenRequest) (*api.IssuedToken, error) {
 	ctx, span := g.tracer.Start(ctx, "IssueToken")
 	defer span.End()
 
@@ -37,23 +42,90 @@ func (g *Issuer) IssueToken(ctx context.Context, req *api.TokenRequest) (string,
 	for k, v := range req.Permissions {
 		perms = append(perms, fmt.Sprintf("%s:%s", k, v))
 	}
-	g.log.Info("requesting token", "repositories", tokReq.Repositories, "permissions", perms)
-	span.SetAttributes(attribute.StringSlice("repositories", tokReq.Repositories), attribute.StringSlice("permissions", perms))
+	g.log.Info("requesting token", "repositories", req.Repositories, "permissions", req.Permissions)
+	span.SetAttributes(attribute.StringSlice("repositories", req.Repositories), attribute.StringSlice("permissions", perms))
 
-	client, err := g.clients.Client(ctx, req.Owner())
+	var tok *github.InstallationToken
+	err := g.clients.WithClient(ctx, req.Owner(), func(client *Client) error {
+		var err error
+		tok, err = g.createToken(ctx, client, tokReq)
+		return err
+	})
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return "", err
+		return nil, err
 	}
+	return ConvertInstallationToken(tok)
+}
 
+func (g *Issuer) createToken(ctx context.Context, client *Client, tokReq *github.InstallationTokenOptions) (*github.InstallationToken, error) {
+	start := time.Now()
 	tok, _, err := client.Apps.CreateInstallationToken(ctx, client.installationID, tokReq)
+	metrics.GitHubCreateTokenDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("creating installation token: %w", err)
+	}
+	return tok, nil
+}
+
+// RevokeToken revokes an installation token, so it can't be used for the rest of its lifetime.
+// The owner selects the GitHub instance the token was issued by, and may be empty for the default.
+func (g *Issuer) RevokeToken(ctx context.Context, owner, tok string) error {
+	ctx, span := g.tracer.Start(ctx, "RevokeToken")
+	defer span.End()
+
+	client, err := g.clients.TokenClient(owner, tok)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return "", fmt.Errorf("creating installation token: %w", err)
+		return &api.ClientError{Status: http.StatusBadRequest, Err: err}
+	}
+	if _, err := client.Apps.RevokeInstallationToken(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return revokeError(fmt.Errorf("revoking installation token: %w", err))
+	}
+	return nil
+}
+
+// revokeError reports GitHub rejecting the token as a client error, rather than a failure to revoke it.
+func revokeError(err error) error {
+	var errResp *github.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil {
+		return err
+	}
+	status := errResp.Response.StatusCode
+	if status < 400 || status >= 500 {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		// The request is authenticated by the token being revoked, so the token is invalid - not the client's credentials:
+		status = http.StatusBadRequest
+	}
+	return &api.ClientError{Status: status, Err: err}
+}
+
+// ConvertInstallationToken reports the access GitHub granted to a token, which may be narrower than requested.
+func ConvertInstallationToken(tok *github.InstallationToken) (*api.IssuedToken, error) {
+	issued := &api.IssuedToken{
+		Token:     tok.GetToken(),
+		ExpiresAt: tok.GetExpiresAt().Time,
+	}
+
+	// InstallationPermissions is tagged with the same names used by requests:
+	permsJSON, err := json.Marshal(tok.GetPermissions())
+	if err != nil {
+		return nil, fmt.Errorf("marshaling token permissions: %w", err)
+	}
+	if err := json.Unmarshal(permsJSON, &issued.Permissions); err != nil {
+		return nil, fmt.Errorf("unmarshaling token permissions: %w", err)
+	}
+
+	for _, repo := range tok.Repositories {
+		issued.Repositories = append(issued.Repositories, repo.GetFullName())
 	}
-	return tok.GetToken(), nil
+	return issued, nil
 }
 
 func ConvertTokenRequest(req *api.TokenRequest) *github.InstallationTokenOptions {
@@ -2,10 +2,16 @@ package github_test
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	gh "github.com/google/go-github/v62/github"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/github-token-factory-oidc/api"
@@ -24,7 +30,7 @@ func TestIssuer(t *testing.T) {
 		},
 	}
 
-	iss := github.NewIssuer(slog.Default(), noop.NewTracerProvider().Tracer(""), github.NewClients(http.DefaultTransport, configs))
+	iss := github.NewIssuer(slog.Default(), noop.NewTracerProvider().Tracer(""), newClients(t, http.DefaultTransport, configs, 0))
 
 	tok, err := iss.IssueToken(context.Background(), &api.TokenRequest{
 		Repositories: []string{"thepwagner-org/debian-bullseye"},
@@ -32,3 +38,131 @@ func TestIssuer(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEmpty(t, tok)
 }
+
+func TestConvertInstallationToken(t *testing.T) {
+	t.Parallel()
+	expires := time.Date(2024, 7, 16, 12, 0, 0, 0, time.UTC)
+	tok := &gh.InstallationToken{
+		Token:     gh.String("ghs_token"),
+		ExpiresAt: &gh.Timestamp{Time: expires},
+		Permissions: &gh.InstallationPermissions{
+			Contents:             gh.String("read"),
+			OrganizationProjects: gh.String("write"),
+		},
+		Repositories: []*gh.Repository{
+			{FullName: gh.String("thepwagner/foo")},
+			{FullName: gh.String("thepwagner/bar")},
+		},
+	}
+
+	issued, err := github.ConvertInstallationToken(tok)
+	require.NoError(t, err)
+	assert.Equal(t, "ghs_token", issued.Token)
+	assert.Equal(t, expires, issued.ExpiresAt)
+	assert.Equal(t, map[string]string{"contents": "read", "organization_projects": "write"}, issued.Permissions)
+	assert.Equal(t, []string{"thepwagner/foo", "thepwagner/bar"}, issued.Repositories)
+}
+
+func TestIssuer_RevokeToken(t *testing.T) {
+	t.Parallel()
+
+	var revoked *http.Request
+	transport := roundTripper(func(r *http.Request) (*http.Response, error) {
+		revoked = r
+		return &http.Response{
+			StatusCode: http.StatusNoContent,
+			Body:       http.NoBody,
+			Request:    r,
+		}, nil
+	})
+	iss := github.NewIssuer(slog.Default(), noop.NewTracerProvider().Tracer(""), newClients(t, transport, nil, 0))
+
+	err := iss.RevokeToken(context.Background(), "", "ghs_token")
+	require.NoError(t, err)
+	require.NotNil(t, revoked)
+	assert.Equal(t, http.MethodDelete, revoked.Method)
+	assert.Equal(t, "/installation/token", revoked.URL.Path)
+	assert.Equal(t, "Bearer ghs_token", revoked.Header.Get("Authorization"))
+
+	// Tokens of unknown owners aren't sent to the default instance:
+	revoked = nil
+	err = iss.RevokeToken(context.Background(), "unknown", "ghs_token")
+	var clientErr *api.ClientError
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, http.StatusBadRequest, clientErr.Status)
+	assert.Nil(t, revoked)
+}
+
+func TestIssuer_RevokeTokenRejected(t *testing.T) {
+	t.Parallel()
+	cases := map[int]int{
+		http.StatusUnauthorized:        http.StatusBadRequest,
+		http.StatusNotFound:            http.StatusNotFound,
+		http.StatusInternalServerError: 0,
+	}
+	for githubStatus, status := range cases {
+		transport := roundTripper(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: githubStatus,
+				Body:       io.NopCloser(strings.NewReader(`{"message": "rejected"}`)),
+				Request:    r,
+			}, nil
+		})
+		iss := github.NewIssuer(slog.Default(), noop.NewTracerProvider().Tracer(""), newClients(t, transport, nil, 0))
+
+		err := iss.RevokeToken(context.Background(), "", "ghs_token")
+		require.Error(t, err, githubStatus)
+		var clientErr *api.ClientError
+		if status == 0 {
+			assert.False(t, errors.As(err, &clientErr), "GitHub failures aren't the client's")
+			continue
+		}
+		require.ErrorAs(t, err, &clientErr, githubStatus)
+		assert.Equal(t, status, clientErr.Status, githubStatus)
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestIssuer_StaleInstallation(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {AppID: 1, PrivateKeyPath: writePrivateKey(t), BaseURL: gh.URL},
+	}, time.Hour)
+	iss := github.NewIssuer(slog.Default(), noop.NewTracerProvider().Tracer(""), clients)
+	ctx := context.Background()
+	req := &api.TokenRequest{Repositories: []string{"acme/gtfo"}, Permissions: map[string]string{"contents": "read"}}
+
+	_, err := iss.IssueToken(ctx, req)
+	require.NoError(t, err)
+
+	// The app is reinstalled, so the cached installation is evicted and found again:
+	gh.installationID.Store(2)
+	tok, err := iss.IssueToken(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "ghs_installation", tok.Token)
+	assert.Equal(t, int32(2), gh.lookups.Load())
+}
+
+func TestIssuer_Uninstalled(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	var requests atomic.Int32
+	counting := roundTripper(func(r *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	clients := newClients(t, counting, map[string]github.Config{
+		"*": {AppID: 1, PrivateKeyPath: writePrivateKey(t), BaseURL: gh.URL},
+	}, time.Hour)
+	iss := github.NewIssuer(slog.Default(), noop.NewTracerProvider().Tracer(""), clients)
+	req := &api.TokenRequest{Repositories: []string{"other/gtfo"}, Permissions: map[string]string{"contents": "read"}}
+
+	// The installation isn't found, which isn't retried as if a cached installation was stale:
+	_, err := iss.IssueToken(context.Background(), req)
+	require.ErrorContains(t, err, "finding org+user installation")
+	assert.Equal(t, int32(2), requests.Load(), "org and user installations are looked up once")
+}
@@ -0,0 +1,393 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ghinstallation "github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/thepwagner/github-token-factory-oidc/filewatch"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
+)
+
+// KeyConfig is a source of an app private key, exactly one source must be set.
+type KeyConfig struct {
+	// PEM file, reloaded when it changes.
+	Path string
+	// Inline PEM.
+	PEM string
+	// Name of an environment variable holding base64 encoded PEM.
+	Env string
+	// URL of a RemoteSigner holding the key, requested with the headers.
+	URL     string
+	Headers map[string]string
+	// Signer holding the key, for keys that can't be configured by name - e.g. in a KMS.
+	Signer Signer `mapstructure:"-"`
+}
+
+// keyConfigs returns the sources of the app's keys, newest first.
+func (c Config) keyConfigs() []KeyConfig {
+	var keys []KeyConfig
+	if c.PrivateKeyPath != "" || c.PrivateKey != "" || c.PrivateKeyEnv != "" {
+		keys = append(keys, KeyConfig{Path: c.PrivateKeyPath, PEM: c.PrivateKey, Env: c.PrivateKeyEnv})
+	}
+	return append(keys, c.PrivateKeys...)
+}
+
+// defaultKeyRetryInterval is how long older keys are used after the newest key is rejected, before it's tried again.
+const defaultKeyRetryInterval = 5 * time.Minute
+
+// defaultKeyProbeInterval is how often health checks sign with keys held outside the server.
+const defaultKeyProbeInterval = time.Minute
+
+// appKeys signs app JWTs with the newest key, falling back to older keys while GitHub rejects it.
+type appKeys struct {
+	log    *slog.Logger
+	appID  string
+	keys   []Signer
+	active atomic.Int32
+	// fellBack is when the active key was last changed by a fallback, in Unix nanoseconds.
+	fellBack      atomic.Int64
+	retryInterval time.Duration
+	// probes are the last health check signatures of each key.
+	probes        []keyProbe
+	probeInterval time.Duration
+
+	metricsMu sync.Mutex
+	// keyIDs are the key IDs last reported in metrics.
+	keyIDs []string
+}
+
+var _ ghinstallation.Signer = (*appKeys)(nil)
+
+func loadAppKeys(ctx context.Context, log *slog.Logger, client *http.Client, cfg Config) (*appKeys, error) {
+	configs := cfg.keyConfigs()
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no private key configured")
+	}
+	k := &appKeys{
+		appID:         strconv.FormatInt(cfg.AppID, 10),
+		retryInterval: cfg.KeyRetryInterval,
+		probes:        make([]keyProbe, len(configs)),
+		probeInterval: cfg.KeyProbeInterval,
+	}
+	if k.retryInterval == 0 {
+		k.retryInterval = defaultKeyRetryInterval
+	}
+	if k.probeInterval == 0 {
+		k.probeInterval = defaultKeyProbeInterval
+	}
+	k.log = log.With("app_id", k.appID)
+	for i, kc := range configs {
+		key, err := loadSigner(ctx, client, kc)
+		if err != nil {
+			return nil, fmt.Errorf("loading key %d: %w", i, err)
+		}
+		k.keys = append(k.keys, key)
+		k.log.Info("loaded app key", "key_id", keyID(key), "active", i == 0)
+	}
+	for _, key := range k.keys {
+		if key, ok := key.(*appKey); ok {
+			key.onReload(k.reloaded)
+		}
+	}
+	k.metrics()
+	return k, nil
+}
+
+// Sign signs an app JWT with the active key, for ghinstallation which doesn't pass the request's context.
+func (k *appKeys) Sign(claims jwt.Claims) (string, error) {
+	return signJWT(context.Background(), k.keys[k.current()], claims)
+}
+
+// current returns the active key, going back to the newest key once older keys have been used for the retry interval.
+func (k *appKeys) current() int32 {
+	active := k.active.Load()
+	if active == 0 || time.Since(time.Unix(0, k.fellBack.Load())) < k.retryInterval {
+		return active
+	}
+	if k.active.CompareAndSwap(active, 0) {
+		k.log.Info("retrying newest app key", "key_id", keyID(k.keys[0]))
+		k.metrics()
+	}
+	return k.active.Load()
+}
+
+// keyProbe is the outcome of the last health check signature of a key.
+type keyProbe struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+// CheckHealth signs an app JWT with each key, returning the first error.
+// Keys held in memory sign on every check, other keys at most once per probe interval.
+func (k *appKeys) CheckHealth(ctx context.Context) error {
+	for i, key := range k.keys {
+		if err := k.probe(ctx, i, key); err != nil {
+			return fmt.Errorf("key %s: %w", keyID(key), err)
+		}
+	}
+	return nil
+}
+
+func (k *appKeys) probe(ctx context.Context, i int, key Signer) error {
+	if key, ok := key.(*appKey); ok {
+		// A broken reload keeps signing with the previous key, but must still be fixed:
+		if err := key.Err(); err != nil {
+			return err
+		}
+		_, err := signJWT(ctx, key, appClaims(k.appID))
+		return err
+	}
+
+	p := &k.probes[i]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.at) < k.probeInterval {
+		// Between probes, a remote signer reports its last signature - which may be newer than the probe:
+		if signer, ok := key.(*RemoteSigner); ok {
+			return signer.Err()
+		}
+		return p.err
+	}
+	_, p.err = signJWT(ctx, key, appClaims(k.appID))
+	p.at = time.Now()
+	return p.err
+}
+
+// fallback switches from a rejected key to the next, returning the key now in use.
+func (k *appKeys) fallback(rejected int32) int32 {
+	next := (rejected + 1) % int32(len(k.keys))
+	if k.active.CompareAndSwap(rejected, next) {
+		k.fellBack.Store(time.Now().UnixNano())
+		k.log.Warn("app key rejected, falling back to next key", "rejected_key_id", keyID(k.keys[rejected]), "key_id", keyID(k.keys[next]))
+		k.metrics()
+	}
+	return k.active.Load()
+}
+
+// reloaded reports a key that was replaced by reloading its file.
+func (k *appKeys) reloaded(key Signer) {
+	k.log.Info("reloaded app key", "key_id", keyID(key))
+	k.metrics()
+}
+
+// metrics reports which key is in use, dropping keys that were replaced.
+func (k *appKeys) metrics() {
+	k.metricsMu.Lock()
+	defer k.metricsMu.Unlock()
+	active := k.active.Load()
+	keyIDs := make([]string, 0, len(k.keys))
+	for i, key := range k.keys {
+		id := keyID(key)
+		keyIDs = append(keyIDs, id)
+		v := 0.0
+		if int32(i) == active {
+			v = 1
+		}
+		metrics.GitHubAppKey.WithLabelValues(k.appID, id).Set(v)
+	}
+	for _, id := range k.keyIDs {
+		if !slices.Contains(keyIDs, id) {
+			metrics.GitHubAppKey.DeleteLabelValues(k.appID, id)
+		}
+	}
+	k.keyIDs = keyIDs
+}
+
+// transport wraps the transport of an AppsTransport, retrying requests rejected by GitHub with the app's other keys.
+func (k *appKeys) transport(next http.RoundTripper) http.RoundTripper {
+	return keyFallback{keys: k, next: next}
+}
+
+type keyFallback struct {
+	keys *appKeys
+	next http.RoundTripper
+}
+
+func (t keyFallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	used := t.keys.current()
+	resp, err := t.next.RoundTrip(req)
+	for attempt := 1; attempt < len(t.keys.keys); attempt++ {
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+			// Only app JWTs are signed by the app's keys, not installation tokens
+			break
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// The request can't be replayed
+			break
+		}
+
+		used = t.keys.fallback(used)
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		token, signErr := signJWT(req.Context(), t.keys.keys[used], appClaims(t.keys.appID))
+		if signErr != nil {
+			return nil, fmt.Errorf("could not sign jwt: %w", signErr)
+		}
+		retry.Header.Set("Authorization", "Bearer "+token)
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		resp, err = t.next.RoundTrip(retry)
+	}
+	return resp, err
+}
+
+// appClaims are the claims of an app JWT, like ghinstallation.AppsTransport signs.
+func appClaims(appID string) *jwt.RegisteredClaims {
+	iat := time.Now().Add(-30 * time.Second).Truncate(time.Second)
+	return &jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(iat),
+		ExpiresAt: jwt.NewNumericDate(iat.Add(2 * time.Minute)),
+		Issuer:    appID,
+	}
+}
+
+// appKey signs app JWTs with a private key held in memory, that may be reloaded from a file.
+type appKey struct {
+	mu  sync.RWMutex
+	key *rsa.PrivateKey
+	err error
+	// reloaded is called after the key is replaced by reloading its file.
+	reloaded func(Signer)
+}
+
+var _ Signer = (*appKey)(nil)
+
+// loadSigner loads a key from exactly one source.
+// Keys loaded from a file are reloaded when it changes, until the context is cancelled.
+func loadSigner(ctx context.Context, client *http.Client, cfg KeyConfig) (Signer, error) {
+	var sources int
+	for _, s := range []string{cfg.PEM, cfg.Env, cfg.Path, cfg.URL} {
+		if s != "" {
+			sources++
+		}
+	}
+	if cfg.Signer != nil {
+		sources++
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("exactly one of private_key, private_key_env, private_key_path, url or signer must be set")
+	}
+
+	switch {
+	case cfg.Signer != nil:
+		return cfg.Signer, nil
+	case cfg.URL != "":
+		return NewRemoteSigner(ctx, client, cfg.URL, cfg.Headers)
+	}
+
+	k := &appKey{}
+	switch {
+	case cfg.PEM != "":
+		if err := k.set([]byte(cfg.PEM)); err != nil {
+			return nil, err
+		}
+	case cfg.Env != "":
+		encoded, ok := os.LookupEnv(cfg.Env)
+		if !ok {
+			return nil, fmt.Errorf("private key variable %q is not set", cfg.Env)
+		}
+		pem, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("decoding private key variable %q: %w", cfg.Env, err)
+		}
+		if err := k.set(pem); err != nil {
+			return nil, err
+		}
+	default:
+		if err := k.load(cfg.Path); err != nil {
+			return nil, err
+		}
+		if err := k.watch(ctx, cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *appKey) PublicKey() *rsa.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return &k.key.PublicKey
+}
+
+func (k *appKey) SignDigest(_ context.Context, digest []byte) ([]byte, error) {
+	k.mu.RLock()
+	key := k.key
+	k.mu.RUnlock()
+	return rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest)
+}
+
+// Err returns the error of the last reload, while the previous key is still used.
+func (k *appKey) Err() error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.err
+}
+
+func (k *appKey) onReload(reloaded func(Signer)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reloaded = reloaded
+}
+
+func (k *appKey) set(pem []byte) error {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+	if err != nil {
+		return fmt.Errorf("parsing private key: %w", err)
+	}
+	k.mu.Lock()
+	k.key = key
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *appKey) load(path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading private key: %w", err)
+	}
+	return k.set(pem)
+}
+
+// watch reloads the key when its file changes.
+func (k *appKey) watch(ctx context.Context, path string) error {
+	watcher, err := filewatch.Dir(path)
+	if err != nil {
+		return fmt.Errorf("watching private key: %w", err)
+	}
+	go filewatch.Run(ctx, watcher, func() { k.reload(path) }, nil)
+	return nil
+}
+
+// reload keeps signing with the previous key if the new one is broken.
+func (k *appKey) reload(path string) {
+	err := k.load(path)
+	k.mu.Lock()
+	k.err = err
+	reloaded := k.reloaded
+	k.mu.Unlock()
+	if err == nil && reloaded != nil {
+		reloaded(k)
+	}
+}
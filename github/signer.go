@@ -0,0 +1,159 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Signer signs app JWTs with a private key, which may be held outside the server - e.g. in a KMS or HSM.
+type Signer interface {
+	// PublicKey of the signing key.
+	PublicKey() *rsa.PublicKey
+	// SignDigest returns the RSASSA-PKCS1-v1_5 signature of a SHA-256 digest.
+	SignDigest(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// signJWT signs claims as an RS256 JWT.
+func signJWT(ctx context.Context, signer Signer, claims jwt.Claims) (string, error) {
+	signingString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SigningString()
+	if err != nil {
+		return "", fmt.Errorf("encoding jwt: %w", err)
+	}
+	digest := sha256.Sum256([]byte(signingString))
+	sig, err := signer.SignDigest(ctx, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingString + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// keyID returns the SHA256 fingerprint of a signer's key, as GitHub displays it.
+func keyID(signer Signer) string {
+	der, err := x509.MarshalPKIXPublicKey(signer.PublicKey())
+	if err != nil {
+		return ""
+	}
+	fingerprint := sha256.Sum256(der)
+	return "SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:])
+}
+
+// remoteSignTimeout bounds each signature, since app JWTs are signed without the request's context.
+const remoteSignTimeout = 10 * time.Second
+
+// RemoteSigner signs with a key held by a remote service:
+// GET of the URL returns the PEM public key as {"public_key": "..."},
+// POST of {"algorithm": "RS256", "digest": "<base64>"} returns {"signature": "<base64>"}.
+type RemoteSigner struct {
+	client    *http.Client
+	url       string
+	headers   map[string]string
+	publicKey *rsa.PublicKey
+
+	mu  sync.RWMutex
+	err error
+}
+
+var _ Signer = (*RemoteSigner)(nil)
+
+// NewRemoteSigner creates a RemoteSigner, fetching its public key.
+func NewRemoteSigner(ctx context.Context, client *http.Client, url string, headers map[string]string) (*RemoteSigner, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &RemoteSigner{client: client, url: url, headers: headers}
+
+	var res struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := s.do(ctx, http.MethodGet, nil, &res); err != nil {
+		return nil, fmt.Errorf("fetching public key: %w", err)
+	}
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(res.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	s.publicKey = publicKey
+	return s, nil
+}
+
+func (s *RemoteSigner) PublicKey() *rsa.PublicKey {
+	return s.publicKey
+}
+
+func (s *RemoteSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, error) {
+	sig, err := s.signDigest(ctx, digest)
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	return sig, err
+}
+
+// Err returns the error of the last signature, so health checks can report it between probes.
+func (s *RemoteSigner) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+func (s *RemoteSigner) signDigest(ctx context.Context, digest []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteSignTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]string{
+		"algorithm": "RS256",
+		"digest":    base64.StdEncoding.EncodeToString(digest),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling sign request: %w", err)
+	}
+	var res struct {
+		Signature []byte `json:"signature"`
+	}
+	if err := s.do(ctx, http.MethodPost, body, &res); err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	// Don't send GitHub signatures by some other key:
+	if err := rsa.VerifyPKCS1v15(s.publicKey, crypto.SHA256, digest, res.Signature); err != nil {
+		return nil, fmt.Errorf("verifying signature: %w", err)
+	}
+	return res.Signature, nil
+}
+
+func (s *RemoteSigner) do(ctx context.Context, method string, body []byte, res interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package github_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/github"
+)
+
+// newRemoteSigner serves a RemoteSigner's API, signing with signingKey while advertising publicKey.
+func newRemoteSigner(t *testing.T, signingKey *rsa.PrivateKey, publicKey *rsa.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kms" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(map[string]string{"public_key": string(publicPEM)})
+		case http.MethodPost:
+			var req struct {
+				Algorithm string `json:"algorithm"`
+				Digest    []byte `json:"digest"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Algorithm != "RS256" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sig, err := rsa.SignPKCS1v15(nil, signingKey, crypto.SHA256, req.Digest)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"signature": base64.StdEncoding.EncodeToString(sig)})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestRemoteSigner(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	key, _ := privateKeyPEM(t)
+	gh.trustedKey.Store(&key.PublicKey)
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {
+			AppID: 1,
+			PrivateKeys: []github.KeyConfig{{
+				URL:     newRemoteSigner(t, key, &key.PublicKey),
+				Headers: map[string]string{"Authorization": "Bearer kms"},
+			}},
+			BaseURL: gh.URL,
+		},
+	}, 0)
+	ctx := context.Background()
+
+	client, err := clients.Client(ctx, "acme")
+	require.NoError(t, err)
+	_, _, err = client.Apps.CreateInstallationToken(ctx, 1, nil)
+	require.NoError(t, err)
+	for owner, err := range clients.CheckHealth(ctx) {
+		assert.NoError(t, err, owner)
+	}
+}
+
+func TestRemoteSigner_Invalid(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	key, _ := privateKeyPEM(t)
+	otherKey, _ := privateKeyPEM(t)
+	headers := map[string]string{"Authorization": "Bearer kms"}
+
+	_, err := github.NewRemoteSigner(ctx, nil, newRemoteSigner(t, key, &key.PublicKey), nil)
+	assert.Error(t, err, "unauthorized")
+
+	// Signatures by another key than advertised are rejected:
+	signer, err := github.NewRemoteSigner(ctx, nil, newRemoteSigner(t, otherKey, &key.PublicKey), headers)
+	require.NoError(t, err)
+	require.NoError(t, signer.Err())
+	_, err = signer.SignDigest(ctx, make([]byte, 32))
+	assert.Error(t, err)
+	assert.Equal(t, err, signer.Err())
+}
+
+func TestRemoteSigner_CheckHealth(t *testing.T) {
+	t.Parallel()
+	key, _ := privateKeyPEM(t)
+	signer := newRemoteSigner(t, key, &key.PublicKey)
+	var signatures atomic.Int32
+	var unavailable atomic.Bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			signatures.Add(1)
+			if unavailable.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, signer, r.Body)
+		require.NoError(t, err)
+		req.Header = r.Header
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(proxy.Close)
+	const probeInterval = 200 * time.Millisecond
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {
+			AppID: 1,
+			PrivateKeys: []github.KeyConfig{{
+				URL:     proxy.URL,
+				Headers: map[string]string{"Authorization": "Bearer kms"},
+			}},
+			KeyProbeInterval: probeInterval,
+		},
+	}, 0)
+	ctx := context.Background()
+
+	// The signer is probed once per interval, not on every check:
+	assert.NoError(t, clients.CheckHealth(ctx)["github/acme"])
+	assert.NoError(t, clients.CheckHealth(ctx)["github/acme"])
+	assert.Equal(t, int32(1), signatures.Load())
+
+	unavailable.Store(true)
+	assert.NoError(t, clients.CheckHealth(ctx)["github/acme"])
+	require.Eventually(t, func() bool {
+		return clients.CheckHealth(ctx)["github/acme"] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), signatures.Load())
+}
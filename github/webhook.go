@@ -0,0 +1,148 @@
+package github
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// maxWebhookPayload is the largest webhook payload GitHub delivers.
+const maxWebhookPayload = 25 << 20
+
+// WebhookHandler receives webhooks for the configured apps, to keep cached clients and policies fresh.
+type WebhookHandler struct {
+	log     *slog.Logger
+	clients *Clients
+	// secrets of each app, by app ID.
+	secrets map[int64][][]byte
+
+	policyPath       string
+	invalidatePolicy func(repo string)
+}
+
+// NewWebhookHandler creates a WebhookHandler. Pushes to policyPath in a repository's default branch call invalidatePolicy.
+func NewWebhookHandler(log *slog.Logger, clients *Clients, policyPath string, invalidatePolicy func(repo string)) *WebhookHandler {
+	secrets := make(map[int64][][]byte)
+	for _, cfg := range clients.configs {
+		if cfg.WebhookSecret != "" {
+			secrets[cfg.AppID] = append(secrets[cfg.AppID], []byte(cfg.WebhookSecret))
+		}
+	}
+	return &WebhookHandler{
+		log:              log.With("logger", "github.WebhookHandler"),
+		clients:          clients,
+		secrets:          secrets,
+		policyPath:       policyPath,
+		invalidatePolicy: invalidatePolicy,
+	}
+}
+
+// Enabled returns true if any app has a webhook secret.
+func (h *WebhookHandler) Enabled() bool {
+	return len(h.secrets) > 0
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, "reading payload", http.StatusBadRequest)
+		return
+	}
+	payload, err := h.validate(r, body)
+	if err != nil {
+		h.log.Warn("rejected webhook", slog.String("err", err.Error()))
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	eventType := github.WebHookType(r)
+	event, err := github.ParseWebHook(eventType, payload)
+	if err != nil {
+		// Apps may subscribe to events we don't care about:
+		h.log.Debug("ignoring webhook", "event", eventType, slog.String("err", err.Error()))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.handle(event)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validate checks the payload was signed by the app it was delivered for.
+func (h *WebhookHandler) validate(r *http.Request, body []byte) ([]byte, error) {
+	appID, err := strconv.ParseInt(r.Header.Get("X-GitHub-Hook-Installation-Target-ID"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing app ID: %w", err)
+	}
+	secrets, ok := h.secrets[appID]
+	if !ok {
+		return nil, fmt.Errorf("no webhook secret for app %d", appID)
+	}
+
+	signature := r.Header.Get(github.SHA256SignatureHeader)
+	if signature == "" {
+		return nil, fmt.Errorf("missing %s header", github.SHA256SignatureHeader)
+	}
+	contentType := r.Header.Get("Content-Type")
+	for _, secret := range secrets {
+		payload, err := github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), signature, secret)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("payload signature does not match app %d", appID)
+}
+
+func (h *WebhookHandler) handle(event interface{}) {
+	switch e := event.(type) {
+	case *github.InstallationEvent:
+		owner := e.GetInstallation().GetAccount().GetLogin()
+		h.log.Info("installation changed", "owner", owner, "action", e.GetAction())
+		h.clients.Evict(owner)
+	case *github.InstallationRepositoriesEvent:
+		owner := e.GetInstallation().GetAccount().GetLogin()
+		h.log.Info("installation repositories changed", "owner", owner, "action", e.GetAction())
+		h.clients.Evict(owner)
+	case *github.GitHubAppAuthorizationEvent:
+		// Revoked user authorizations don't affect installation tokens:
+		h.log.Info("app authorization changed", "user", e.GetSender().GetLogin(), "action", e.GetAction())
+	case *github.PushEvent:
+		repo := e.GetRepo().GetFullName()
+		if h.invalidatePolicy != nil && h.touchesPolicy(e) {
+			h.log.Info("policy changed", "repository", repo, "after", e.GetAfter())
+			h.invalidatePolicy(repo)
+		}
+	}
+}
+
+// maxPushCommits is the most commits a push webhook lists, larger pushes are truncated.
+const maxPushCommits = 2048
+
+// touchesPolicy returns true if a push to the default branch may have changed the policy.
+func (h *WebhookHandler) touchesPolicy(e *github.PushEvent) bool {
+	if e.GetRef() != "refs/heads/"+e.GetRepo().GetDefaultBranch() {
+		return false
+	}
+	// Unlisted commits of a truncated payload may have changed the policy:
+	if len(e.Commits) >= maxPushCommits || e.GetSize() > len(e.Commits) {
+		return true
+	}
+	commits := append([]*github.HeadCommit{e.HeadCommit}, e.Commits...)
+	for _, commit := range commits {
+		if commit == nil {
+			continue
+		}
+		for _, files := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, f := range files {
+				if f == h.policyPath {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package github_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/github"
+)
+
+const webhookSecret = "webhook-secret"
+
+func deliver(t *testing.T, h http.Handler, appID, event, payload, secret string) int {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+
+	req := httptest.NewRequest("POST", "/v1/webhooks/github", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Hook-Installation-Target-ID", appID)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestWebhookHandler_Signature(t *testing.T) {
+	t.Parallel()
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme":  {AppID: 1, PrivateKeyPath: writePrivateKey(t), WebhookSecret: webhookSecret},
+		"other": {AppID: 2, PrivateKeyPath: writePrivateKey(t)},
+	}, 0)
+	h := github.NewWebhookHandler(slog.Default(), clients, ".github/tokens.rego", nil)
+	assert.True(t, h.Enabled())
+
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "ping", `{"zen": "hi"}`, webhookSecret))
+	assert.Equal(t, http.StatusUnauthorized, deliver(t, h, "1", "ping", `{"zen": "hi"}`, "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, deliver(t, h, "2", "ping", `{"zen": "hi"}`, webhookSecret))
+	assert.Equal(t, http.StatusUnauthorized, deliver(t, h, "", "ping", `{"zen": "hi"}`, webhookSecret))
+
+	disabled := github.NewWebhookHandler(slog.Default(), newClients(t, http.DefaultTransport, nil, 0), ".github/tokens.rego", nil)
+	assert.False(t, disabled.Enabled())
+}
+
+func TestWebhookHandler_Installation(t *testing.T) {
+	t.Parallel()
+	gh := newFakeInstallations(t)
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"acme": {AppID: 1, PrivateKeyPath: writePrivateKey(t), BaseURL: gh.URL, WebhookSecret: webhookSecret},
+	}, time.Hour)
+	h := github.NewWebhookHandler(slog.Default(), clients, ".github/tokens.rego", nil)
+	ctx := context.Background()
+
+	_, err := clients.Client(ctx, "acme")
+	require.NoError(t, err)
+	status := deliver(t, h, "1", "installation", `{"action": "deleted", "installation": {"id": 1, "account": {"login": "acme"}}}`, webhookSecret)
+	assert.Equal(t, http.StatusNoContent, status)
+
+	gh.installationID.Store(2)
+	client, err := clients.Client(ctx, "acme")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), gh.lookups.Load())
+	tok, _, err := client.Apps.CreateInstallationToken(ctx, 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "ghs_installation", tok.GetToken())
+}
+
+func TestWebhookHandler_Push(t *testing.T) {
+	t.Parallel()
+	clients := newClients(t, http.DefaultTransport, map[string]github.Config{
+		"*": {AppID: 1, PrivateKeyPath: writePrivateKey(t), WebhookSecret: webhookSecret},
+	}, 0)
+	var invalidated []string
+	h := github.NewWebhookHandler(slog.Default(), clients, ".github/tokens.rego", func(repo string) {
+		invalidated = append(invalidated, repo)
+	})
+
+	push := func(ref, file string) string {
+		return `{
+			"ref": "` + ref + `",
+			"after": "abc123",
+			"repository": {"full_name": "acme/gtfo", "default_branch": "main"},
+			"commits": [{"modified": ["README.md"]}],
+			"head_commit": {"modified": ["` + file + `"]}
+		}`
+	}
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "push", push("refs/heads/main", ".github/tokens.rego"), webhookSecret))
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "push", push("refs/heads/main", "main.go"), webhookSecret))
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "push", push("refs/heads/feature", ".github/tokens.rego"), webhookSecret))
+	assert.Equal(t, []string{"acme/gtfo"}, invalidated)
+
+	// Pushes with more commits than are listed may have changed the policy:
+	commits := strings.Repeat(`{"modified": ["README.md"]},`, 2047) + `{"modified": ["README.md"]}`
+	truncated := `{
+		"ref": "refs/heads/main",
+		"after": "def456",
+		"repository": {"full_name": "acme/truncated", "default_branch": "main"},
+		"commits": [` + commits + `]
+	}`
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "push", truncated, webhookSecret))
+	sized := `{
+		"ref": "refs/heads/main",
+		"after": "def456",
+		"size": 30,
+		"repository": {"full_name": "acme/sized", "default_branch": "main"},
+		"commits": [{"modified": ["README.md"]}]
+	}`
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "push", sized, webhookSecret))
+	many := `{
+		"ref": "refs/heads/main",
+		"after": "def456",
+		"repository": {"full_name": "acme/many", "default_branch": "main"},
+		"commits": [` + strings.Repeat(`{"modified": ["README.md"]},`, 24) + `{"modified": ["README.md"]}]
+	}`
+	assert.Equal(t, http.StatusNoContent, deliver(t, h, "1", "push", many, webhookSecret))
+	assert.Equal(t, []string{"acme/gtfo", "acme/truncated", "acme/sized"}, invalidated)
+}
@@ -6,19 +6,21 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/lmittmann/tint"
 	"github.com/thepwagner/github-token-factory-oidc/server"
 )
 
 func main() {
-	log := slog.New(
-		tint.NewHandler(os.Stderr, &tint.Options{
-			Level:      slog.LevelDebug,
-			TimeFormat: time.RFC3339,
-		}),
-	)
+	cfg, err := server.NewConfig()
+	if err != nil {
+		slog.Error("failed to load configuration", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	log, err := server.NewLogger(cfg.Log, os.Stderr)
+	if err != nil {
+		slog.Error("failed to configure logging", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -30,7 +32,7 @@ func main() {
 		cancel()
 	}()
 
-	if err := server.Run(ctx, log); err != nil {
+	if err := server.Run(ctx, log, cfg); err != nil {
 		log.Error("failed to run", slog.String("err", err.Error()))
 		os.Exit(1)
 	}
@@ -0,0 +1,94 @@
+// Package metrics defines the Prometheus metrics exported by the server.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gtfo"
+
+// Registry holds every metric exported by the server.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// Requests counts API requests by handler, status code, OIDC issuer and repository owner.
+	// Owners without their own GitHub config are counted as "other".
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "API requests by handler, status code, issuer and owner.",
+	}, []string{"handler", "code", "issuer", "owner"})
+
+	// OIDCVerifyDuration observes verifying OIDC tokens.
+	OIDCVerifyDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "oidc_verify_duration_seconds",
+		Help:      "Time to verify OIDC tokens, by issuer and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"issuer", "result"})
+
+	// PolicyFetchDuration observes loading a repository's policy.
+	PolicyFetchDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "policy_fetch_duration_seconds",
+		Help:      "Time to load repository policies, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// PolicyEvalDuration observes evaluating a Rego policy.
+	PolicyEvalDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "policy_eval_duration_seconds",
+		Help:      "Time to evaluate policies, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// GitHubCreateTokenDuration observes creating installation tokens.
+	GitHubCreateTokenDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "github_create_installation_token_duration_seconds",
+		Help:      "Time to create GitHub installation tokens, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// GitHubClients is the number of cached GitHub clients, by authentication type.
+	GitHubClients = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "github_clients",
+		Help:      "Cached GitHub clients, by authentication type.",
+	}, []string{"type"})
+
+	// GitHubAppKey is 1 for the private key each app signs with, and 0 for its other keys.
+	GitHubAppKey = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "github_app_key",
+		Help:      "Private keys of each GitHub App, 1 if the key is in use.",
+	}, []string{"app_id", "key_id"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Result labels the outcome of an operation.
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,104 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/thepwagner/github-token-factory-oidc/filewatch"
+)
+
+// staticSigningAlgs are accepted from issuers without discovery, the type of each key limits what it verifies.
+var staticSigningAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	oidc.EdDSA,
+}
+
+// parseJWKS parses the signing keys of a JSON Web Key Set.
+func parseJWKS(data []byte) (*oidc.StaticKeySet, error) {
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+	keys := make([]crypto.PublicKey, 0, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		keys = append(keys, k.Public().Key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signing keys")
+	}
+	return &oidc.StaticKeySet{PublicKeys: keys}, nil
+}
+
+// FileKeySet is an oidc.KeySet loaded from a JWKS file, reloading it when the file changes.
+type FileKeySet struct {
+	path string
+
+	mu   sync.RWMutex
+	keys *oidc.StaticKeySet
+	err  error
+}
+
+var _ oidc.KeySet = (*FileKeySet)(nil)
+
+// NewFileKeySet loads keys from path, and watches for changes until the context is cancelled.
+func NewFileKeySet(ctx context.Context, path string) (*FileKeySet, error) {
+	s := &FileKeySet{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := filewatch.Dir(path)
+	if err != nil {
+		return nil, fmt.Errorf("watching JWKS: %w", err)
+	}
+	go filewatch.Run(ctx, watcher, s.reload, nil)
+	return s, nil
+}
+
+func (s *FileKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	s.mu.RLock()
+	keys := s.keys
+	s.mu.RUnlock()
+	return keys.VerifySignature(ctx, jwt)
+}
+
+// Err returns the error of the last reload, while the previous keys are still used.
+func (s *FileKeySet) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+func (s *FileKeySet) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("reading JWKS: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// reload keeps using the previous keys if the new ones are broken.
+func (s *FileKeySet) reload() {
+	err := s.load()
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
@@ -0,0 +1,109 @@
+package oidc_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/oidc"
+)
+
+const issuerKubernetes = "https://kubernetes.default.svc.cluster.local"
+
+func (i *testIssuer) jwksJSON(t *testing.T) string {
+	t.Helper()
+	b, err := json.Marshal(i.jwks())
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestTokenParser_JWKS(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+
+	tp, err := oidc.NewParser(ctx, oidc.IssuerConfig{Issuer: issuerKubernetes, JWKS: iss.jwksJSON(t), AllowAnyAudience: true})
+	require.NoError(t, err)
+	claims, err := tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": issuerKubernetes}))
+	require.NoError(t, err)
+	assert.Equal(t, issuerKubernetes, claims["iss"])
+	assert.Equal(t, int32(0), iss.discoveries.Load())
+
+	_, err = tp.Parse(ctx, newTestIssuer(t).token(t, map[string]interface{}{"iss": issuerKubernetes}))
+	assert.Error(t, err, "tokens signed by other keys are rejected")
+
+	_, err = oidc.NewParser(ctx, oidc.IssuerConfig{Issuer: issuerKubernetes, JWKS: `{"keys": []}`, AllowAnyAudience: true})
+	assert.Error(t, err)
+}
+
+func TestTokenParser_JWKSPath(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	oldKey, newKey := newTestIssuer(t), newTestIssuer(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, []byte(oldKey.jwksJSON(t)), 0o600))
+
+	tp, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: issuerKubernetes, JWKSPath: path, AllowAnyAudience: true})
+	require.NoError(t, err)
+	claims := map[string]interface{}{"iss": issuerKubernetes}
+	_, err = tp.Parse(ctx, oldKey.token(t, claims))
+	require.NoError(t, err)
+	_, err = tp.Parse(ctx, newKey.token(t, claims))
+	require.Error(t, err)
+
+	// Rotate the key by replacing the file:
+	tmp := filepath.Join(filepath.Dir(path), "jwks.json.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte(newKey.jwksJSON(t)), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+	require.Eventually(t, func() bool {
+		_, err := tp.Parse(ctx, newKey.token(t, claims))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = tp.Parse(ctx, oldKey.token(t, claims))
+	assert.Error(t, err)
+
+	// A broken file keeps the previous keys, and is reported as unhealthy:
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	require.Eventually(t, func() bool {
+		return tp.CheckHealth(ctx)["oidc/"+issuerKubernetes] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = tp.Parse(ctx, newKey.token(t, claims))
+	assert.NoError(t, err)
+}
+
+func TestTokenParser_JWKSPathMounted(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	oldKey, newKey := newTestIssuer(t), newTestIssuer(t)
+
+	// Lay the file out like a Kubernetes ConfigMap mount, which updates by swapping the `..data` symlink:
+	dir := t.TempDir()
+	mount := func(name, jwks string) {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "jwks.json"), []byte(jwks), 0o600))
+		require.NoError(t, os.Symlink(name, filepath.Join(dir, "..data_tmp")))
+		require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	mount("..v1", oldKey.jwksJSON(t))
+	path := filepath.Join(dir, "jwks.json")
+	require.NoError(t, os.Symlink(filepath.Join("..data", "jwks.json"), path))
+
+	tp, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: issuerKubernetes, JWKSPath: path, AllowAnyAudience: true})
+	require.NoError(t, err)
+	claims := map[string]interface{}{"iss": issuerKubernetes}
+	_, err = tp.Parse(ctx, oldKey.token(t, claims))
+	require.NoError(t, err)
+
+	mount("..v2", newKey.jwksJSON(t))
+	require.Eventually(t, func() bool {
+		_, err := tp.Parse(ctx, newKey.token(t, claims))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,97 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+const (
+	minDiscoveryBackoff = 500 * time.Millisecond
+	maxDiscoveryBackoff = time.Minute
+)
+
+var errDiscoveryPending = errors.New("discovery pending")
+
+// LazyTokenParser discovers its issuer in the background, retrying with backoff until it succeeds.
+// Until then, tokens from the issuer are rejected without affecting other issuers.
+type LazyTokenParser struct {
+	issuer string
+	// attempted is closed after the first discovery attempt.
+	attempted chan struct{}
+
+	mu     sync.RWMutex
+	parser *TokenParser
+	err    error
+}
+
+var (
+	_ api.TokenParser   = (*LazyTokenParser)(nil)
+	_ api.HealthChecker = (*LazyTokenParser)(nil)
+)
+
+// NewLazyTokenParser starts discovering the issuer, until it succeeds or the context is cancelled.
+func NewLazyTokenParser(ctx context.Context, issuer IssuerConfig, opts ...TokenParserOpt) *LazyTokenParser {
+	p := &LazyTokenParser{
+		issuer:    issuer.Issuer,
+		attempted: make(chan struct{}),
+		err:       errDiscoveryPending,
+	}
+	go p.discover(ctx, issuer, opts)
+	return p
+}
+
+func (p *LazyTokenParser) discover(ctx context.Context, issuer IssuerConfig, opts []TokenParserOpt) {
+	backoff := minDiscoveryBackoff
+	for attempt := 0; ; attempt++ {
+		parser, err := NewTokenParser(ctx, issuer, opts...)
+		p.mu.Lock()
+		p.parser, p.err = parser, err
+		p.mu.Unlock()
+		if attempt == 0 {
+			close(p.attempted)
+		}
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDiscoveryBackoff)
+	}
+}
+
+func (p *LazyTokenParser) Parse(ctx context.Context, tok string) (api.Claims, error) {
+	// Don't reject tokens that arrive while the issuer is first discovered:
+	select {
+	case <-p.attempted:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.RLock()
+	parser, err := p.parser, p.err
+	p.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("issuer %q is unavailable: %w", p.issuer, err)
+	}
+	return parser.Parse(ctx, tok)
+}
+
+// CheckHealth reports the last discovery error, or once discovered, the health of the issuer's keys.
+func (p *LazyTokenParser) CheckHealth(ctx context.Context) map[string]error {
+	p.mu.RLock()
+	parser, err := p.parser, p.err
+	p.mu.RUnlock()
+	if err != nil {
+		return map[string]error{"oidc/" + p.issuer: err}
+	}
+	return parser.CheckHealth(ctx)
+}
@@ -0,0 +1,52 @@
+package oidc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/oidc"
+)
+
+func TestLazyTokenParser_Retry(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	iss := newTestIssuer(t)
+	iss.failures.Store(1)
+
+	tp := oidc.NewLazyTokenParser(ctx, oidc.IssuerConfig{Issuer: iss.URL, AllowAnyAudience: true})
+	tok := iss.token(t, nil)
+
+	// The first discovery fails, so tokens are rejected and the issuer is unhealthy:
+	_, err := tp.Parse(ctx, tok)
+	assert.ErrorContains(t, err, "unavailable")
+	assert.Error(t, tp.CheckHealth(ctx)["oidc/"+iss.URL])
+
+	// Until discovery is retried:
+	require.Eventually(t, func() bool {
+		return tp.CheckHealth(ctx)["oidc/"+iss.URL] == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	claims, err := tp.Parse(ctx, tok)
+	require.NoError(t, err)
+	assert.Equal(t, iss.URL, claims["iss"])
+	assert.Equal(t, int32(2), iss.discoveries.Load())
+}
+
+func TestNewParser_UnavailableIssuer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up, down := newTestIssuer(t), newTestIssuer(t)
+	down.failures.Store(1000)
+
+	tp, err := oidc.NewParser(ctx, oidc.IssuerConfig{Issuer: up.URL, AllowAnyAudience: true}, oidc.IssuerConfig{Issuer: down.URL, AllowAnyAudience: true})
+	require.NoError(t, err, "unavailable issuers don't prevent startup")
+
+	_, err = tp.Parse(ctx, up.token(t, nil))
+	assert.NoError(t, err)
+	_, err = tp.Parse(ctx, down.token(t, nil))
+	assert.ErrorContains(t, err, "unavailable")
+}
@@ -4,41 +4,96 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/thepwagner/github-token-factory-oidc/api"
+	"golang.org/x/sync/singleflight"
 )
 
 // NewParser returns an appropriate parser
-func NewParser(ctx context.Context, issuers ...string) (api.TokenParser, error) {
-	switch len(issuers) {
-	case 0:
+func NewParser(ctx context.Context, issuers ...IssuerConfig) (api.TokenParser, error) {
+	if len(issuers) == 0 {
 		return nil, fmt.Errorf("no issuers")
-	case 1:
+	}
+	for _, issuer := range issuers {
+		if err := issuer.validate(); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(issuers) == 1 && issuers[0].static():
 		return NewTokenParser(ctx, issuers[0])
+	case len(issuers) == 1 && !isIssuerPattern(issuers[0].Issuer):
+		return NewLazyTokenParser(ctx, issuers[0]), nil
 	default:
 		return NewMultiIssuerParser(ctx, issuers...)
 	}
 }
 
-// MultiIssuerParser supports multiple issuers
+// maxDiscoveredIssuers bounds the issuers matching patterns that are remembered, whether discovered or failed.
+// Tokens are unverified until their issuer is discovered, so anyone can present new issuers.
+const maxDiscoveredIssuers = 1000
+
+var errTooManyIssuers = errors.New("too many discovered issuers")
+
+// failedDiscovery remembers an issuer that couldn't be discovered, so it isn't retried until the backoff passes.
+type failedDiscovery struct {
+	err     error
+	until   time.Time
+	backoff time.Duration
+}
+
+// MultiIssuerParser supports multiple issuers.
+// Configured issuers are discovered in the background, and issuers matching a pattern are discovered when first seen.
 type MultiIssuerParser struct {
-	issuers map[string]api.TokenParser
+	// ctx is used to discover issuers, so discovery isn't bound to the request that triggered it.
+	ctx      context.Context
+	issuers  map[string]api.TokenParser
+	patterns []*issuerPattern
+
+	mu         sync.RWMutex
+	discovered map[string]api.TokenParser
+	failed     map[string]failedDiscovery
+	discovery  singleflight.Group
 }
 
 var _ api.TokenParser = (*MultiIssuerParser)(nil)
 
-func NewMultiIssuerParser(ctx context.Context, issuers ...string) (*MultiIssuerParser, error) {
-	parsers := make(map[string]api.TokenParser, len(issuers))
+func NewMultiIssuerParser(ctx context.Context, issuers ...IssuerConfig) (*MultiIssuerParser, error) {
+	p := &MultiIssuerParser{
+		ctx:        ctx,
+		issuers:    make(map[string]api.TokenParser, len(issuers)),
+		discovered: make(map[string]api.TokenParser),
+		failed:     make(map[string]failedDiscovery),
+	}
 	for _, issuer := range issuers {
-		parser, err := NewTokenParser(ctx, issuer)
-		if err != nil {
-			return nil, fmt.Errorf("creating parser for issuer %q: %w", issuer, err)
+		if err := issuer.validate(); err != nil {
+			return nil, err
+		}
+		if isIssuerPattern(issuer.Issuer) {
+			pattern, err := newIssuerPattern(issuer)
+			if err != nil {
+				return nil, err
+			}
+			p.patterns = append(p.patterns, pattern)
+			continue
+		}
+		if issuer.static() {
+			// Configured keys don't need discovery, so errors are fatal:
+			parser, err := NewTokenParser(ctx, issuer)
+			if err != nil {
+				return nil, fmt.Errorf("creating parser for issuer %q: %w", issuer.Issuer, err)
+			}
+			p.issuers[issuer.Issuer] = parser
+			continue
 		}
-		parsers[issuer] = parser
+		p.issuers[issuer.Issuer] = NewLazyTokenParser(ctx, issuer)
 	}
-	return &MultiIssuerParser{issuers: parsers}, nil
+	return p, nil
 }
 
 func (p *MultiIssuerParser) Parse(ctx context.Context, tok string) (api.Claims, error) {
@@ -56,13 +111,102 @@ func (p *MultiIssuerParser) Parse(ctx context.Context, tok string) (api.Claims,
 		return nil, fmt.Errorf("unmarshaling JWT payload: %w", err)
 	}
 
-	parser, ok := p.issuers[payload.Issuer]
-	if !ok {
-		return nil, fmt.Errorf("no parser for issuer %q", payload.Issuer)
+	parser, err := p.parser(payload.Issuer)
+	if err != nil {
+		return nil, err
 	}
 	return parser.Parse(ctx, tok)
 }
 
+func (p *MultiIssuerParser) parser(issuer string) (api.TokenParser, error) {
+	if parser, ok := p.issuers[issuer]; ok {
+		return parser, nil
+	}
+	p.mu.RLock()
+	parser, ok := p.discovered[issuer]
+	failed, retry := p.failed[issuer]
+	p.mu.RUnlock()
+	if ok {
+		return parser, nil
+	}
+	if retry && time.Now().Before(failed.until) {
+		return nil, failed.err
+	}
+
+	for _, pattern := range p.patterns {
+		cfg, ok := pattern.match(issuer)
+		if !ok {
+			continue
+		}
+		res, err, _ := p.discovery.Do(issuer, func() (interface{}, error) {
+			if !retry && p.full() {
+				return nil, fmt.Errorf("discovering issuer %q: %w", issuer, errTooManyIssuers)
+			}
+			parser, err := NewTokenParser(p.ctx, cfg)
+			if err != nil {
+				err = fmt.Errorf("creating parser for issuer %q: %w", issuer, err)
+				p.fail(issuer, err)
+				return nil, err
+			}
+			p.mu.Lock()
+			p.discovered[issuer] = parser
+			delete(p.failed, issuer)
+			p.mu.Unlock()
+			return parser, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.(api.TokenParser), nil
+	}
+	return nil, fmt.Errorf("no parser for issuer %q", issuer)
+}
+
+// full returns true if no more issuers can be remembered, after forgetting failures whose backoff passed.
+func (p *MultiIssuerParser) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.discovered)+len(p.failed) < maxDiscoveredIssuers {
+		return false
+	}
+	now := time.Now()
+	for issuer, failed := range p.failed {
+		if now.After(failed.until) {
+			delete(p.failed, issuer)
+		}
+	}
+	return len(p.discovered)+len(p.failed) >= maxDiscoveredIssuers
+}
+
+// fail remembers a failed discovery, doubling the issuer's backoff.
+func (p *MultiIssuerParser) fail(issuer string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	backoff := minDiscoveryBackoff
+	if prev, ok := p.failed[issuer]; ok {
+		backoff = min(prev.backoff*2, maxDiscoveryBackoff)
+	}
+	p.failed[issuer] = failedDiscovery{err: err, until: time.Now().Add(backoff), backoff: backoff}
+}
+
+var _ api.HealthChecker = (*MultiIssuerParser)(nil)
+
+func (p *MultiIssuerParser) CheckHealth(ctx context.Context) map[string]error {
+	res := make(map[string]error, len(p.issuers))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, parsers := range []map[string]api.TokenParser{p.issuers, p.discovered} {
+		for _, parser := range parsers {
+			if hc, ok := parser.(api.HealthChecker); ok {
+				for component, err := range hc.CheckHealth(ctx) {
+					res[component] = err
+				}
+			}
+		}
+	}
+	return res
+}
+
 type idToken struct {
 	Issuer string `json:"iss"`
 }
@@ -2,11 +2,14 @@ package oidc_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/github-token-factory-oidc/oidc"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestMultiIssuerParser_Actions(t *testing.T) {
@@ -15,7 +18,7 @@ func TestMultiIssuerParser_Actions(t *testing.T) {
 
 	t.Run("issuer found", func(t *testing.T) {
 		t.Parallel()
-		tp, err := oidc.NewMultiIssuerParser(ctx, issuerGitHub)
+		tp, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: issuerGitHub, AllowAnyAudience: true})
 		require.NoError(t, err)
 
 		_, err = tp.Parse(ctx, ghToken)
@@ -24,9 +27,117 @@ func TestMultiIssuerParser_Actions(t *testing.T) {
 
 	t.Run("issuer not found", func(t *testing.T) {
 		t.Parallel()
-		tp, err := oidc.NewMultiIssuerParser(ctx, issuerGoogle)
+		tp, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: issuerGoogle, AllowAnyAudience: true})
 		require.NoError(t, err)
 		_, err = tp.Parse(ctx, ghToken)
 		assert.Error(t, err, "token is expired")
 	})
 }
+
+func TestMultiIssuerParser_CheckHealth(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	a, b := newTestIssuer(t), newTestIssuer(t)
+
+	tp, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: a.URL, AllowAnyAudience: true}, oidc.IssuerConfig{Issuer: b.URL, AllowAnyAudience: true})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		health := tp.CheckHealth(ctx)
+		return len(health) == 2 && health["oidc/"+a.URL] == nil && health["oidc/"+b.URL] == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Once discovered, errors fetching an issuer's keys are reported:
+	b.keysUnavailable.Store(true)
+	_, err = tp.Parse(ctx, b.token(t, nil))
+	require.Error(t, err)
+	health := tp.CheckHealth(ctx)
+	assert.NoError(t, health["oidc/"+a.URL])
+	assert.ErrorContains(t, health["oidc/"+b.URL], "fetching keys")
+}
+
+func TestMultiIssuerParser_Pattern(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+
+	tp, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: iss.URL + "/{enterprise}", Audiences: []string{"gtfo"}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), iss.discoveries.Load(), "pattern issuers are discovered lazily")
+
+	claims, err := tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": iss.URL + "/acme", "aud": "gtfo"}))
+	require.NoError(t, err)
+	assert.Equal(t, iss.URL+"/acme", claims["iss"])
+	_, err = tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": iss.URL + "/acme", "aud": "gtfo"}))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), iss.discoveries.Load(), "discovered issuers are cached")
+
+	_, err = tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": iss.URL + "/acme", "aud": "other"}))
+	assert.ErrorContains(t, err, "audience", "pattern audiences apply to discovered issuers")
+
+	_, err = tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": iss.URL + "/acme/nested", "aud": "gtfo"}))
+	assert.ErrorContains(t, err, "no parser for issuer")
+	_, err = tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": iss.URL, "aud": "gtfo"}))
+	assert.ErrorContains(t, err, "no parser for issuer")
+
+	health := tp.CheckHealth(ctx)
+	assert.Equal(t, map[string]error{"oidc/" + iss.URL + "/acme": nil}, health)
+}
+
+func TestMultiIssuerParser_PatternFailures(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	iss.failures.Store(1 << 20)
+	tp, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: iss.URL + "/{enterprise}", Audiences: []string{"gtfo"}})
+	require.NoError(t, err)
+	parse := func(issuer string) error {
+		_, err := tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": issuer, "aud": "gtfo"}))
+		return err
+	}
+
+	// Failures are remembered, until the backoff passes:
+	for i := 0; i < 3; i++ {
+		assert.Error(t, parse(iss.URL+"/acme"))
+	}
+	assert.Equal(t, int32(1), iss.discoveries.Load())
+	require.Eventually(t, func() bool {
+		_ = parse(iss.URL + "/acme")
+		return iss.discoveries.Load() == 2
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestMultiIssuerParser_MaxDiscovered(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	tp, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: iss.URL + "/{enterprise}", Audiences: []string{"gtfo"}})
+	require.NoError(t, err)
+	parse := func(issuer string) error {
+		_, err := tp.Parse(ctx, iss.token(t, map[string]interface{}{"iss": issuer, "aud": "gtfo"}))
+		return err
+	}
+
+	// Random issuers can't grow the parser without bound:
+	var g errgroup.Group
+	g.SetLimit(16)
+	for i := 0; i < 1000; i++ {
+		issuer := fmt.Sprintf("%s/random-%d", iss.URL, i)
+		g.Go(func() error { return parse(issuer) })
+	}
+	require.NoError(t, g.Wait())
+	discoveries := iss.discoveries.Load()
+	assert.ErrorContains(t, parse(iss.URL+"/one-more"), "too many discovered issuers")
+	assert.Equal(t, discoveries, iss.discoveries.Load())
+	assert.NoError(t, parse(iss.URL+"/random-0"))
+}
+
+func TestMultiIssuerParser_InvalidPattern(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for _, issuer := range []string{"https://*.example.com", "https://example.com/pre*", "*"} {
+		_, err := oidc.NewMultiIssuerParser(ctx, oidc.IssuerConfig{Issuer: issuer, AllowAnyAudience: true})
+		assert.Error(t, err, issuer)
+	}
+}
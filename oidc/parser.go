@@ -3,43 +3,193 @@ package oidc
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
+	"golang.org/x/oauth2"
 )
 
+// IssuerConfig configures a trusted issuer.
+type IssuerConfig struct {
+	Issuer string
+	// Tokens must be issued for at least one of these audiences.
+	Audiences []string
+	// Accept tokens for any audience instead, e.g. for issuers that can't set one.
+	AllowAnyAudience bool `mapstructure:"allow_any_audience"`
+	// For issuers that can't be discovered, a JWKS file (reloaded when it changes) or inline JWKS to verify tokens with.
+	JWKSPath string `mapstructure:"jwks_path"`
+	JWKS     string
+}
+
+// validate rejects issuers whose tokens would be accepted by accident.
+func (c IssuerConfig) validate() error {
+	if len(c.Audiences) == 0 && !c.AllowAnyAudience {
+		return fmt.Errorf("issuer %q has no audiences, set audiences or allow_any_audience", c.Issuer)
+	}
+	return nil
+}
+
+// static returns true if the issuer's keys are configured, instead of discovered.
+func (c IssuerConfig) static() bool {
+	return c.JWKSPath != "" || c.JWKS != ""
+}
+
 // TokenParser parses tokens from a known issuer
 type TokenParser struct {
-	verifier *oidc.IDTokenVerifier
+	issuer    string
+	verifier  *oidc.IDTokenVerifier
+	audiences map[string]struct{}
+	keyFile   *FileKeySet
+	keyFetch  *keyFetch
+
+	allowAnyAudience bool
 }
 
 var _ api.TokenParser = (*TokenParser)(nil)
 
-func NewTokenParser(ctx context.Context, issuer string, opts ...TokenParserOpt) (*TokenParser, error) {
-	prov, err := oidc.NewProvider(ctx, issuer)
-	if err != nil {
-		return nil, fmt.Errorf("creating provider: %w", err)
+func NewTokenParser(ctx context.Context, issuer IssuerConfig, opts ...TokenParserOpt) (*TokenParser, error) {
+	if err := issuer.validate(); err != nil {
+		return nil, err
 	}
+	// The verifier only supports a single audience, they are checked by Parse instead:
 	cfg := &oidc.Config{
 		SkipClientIDCheck: true,
 	}
+	if issuer.static() {
+		cfg.SupportedSigningAlgs = staticSigningAlgs
+	}
 	for _, opt := range opts {
 		opt(cfg)
 	}
-	verifier := prov.Verifier(cfg)
-	return &TokenParser{verifier: verifier}, nil
+
+	p := &TokenParser{issuer: issuer.Issuer, allowAnyAudience: issuer.AllowAnyAudience}
+	switch {
+	case issuer.JWKSPath != "":
+		keys, err := NewFileKeySet(ctx, issuer.JWKSPath)
+		if err != nil {
+			return nil, err
+		}
+		p.keyFile = keys
+		p.verifier = oidc.NewVerifier(issuer.Issuer, keys, cfg)
+	case issuer.JWKS != "":
+		keys, err := parseJWKS([]byte(issuer.JWKS))
+		if err != nil {
+			return nil, err
+		}
+		p.verifier = oidc.NewVerifier(issuer.Issuer, keys, cfg)
+	default:
+		prov, err := oidc.NewProvider(ctx, issuer.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("creating provider: %w", err)
+		}
+		// Keys are fetched when tokens are verified, record the outcome for health checks:
+		p.keyFetch = newKeyFetch(ctx)
+		p.verifier = prov.VerifierContext(oidc.ClientContext(ctx, p.keyFetch.client), cfg)
+	}
+
+	p.audiences = make(map[string]struct{}, len(issuer.Audiences))
+	for _, aud := range issuer.Audiences {
+		p.audiences[aud] = struct{}{}
+	}
+	return p, nil
 }
 
 type TokenParserOpt func(*oidc.Config)
 
+var _ api.HealthChecker = (*TokenParser)(nil)
+
+// CheckHealth reports the last error loading the issuer's keys: reloading its JWKS file, or fetching its discovered JWKS.
+// Inline JWKS can't fail after the parser is created.
+func (p *TokenParser) CheckHealth(context.Context) map[string]error {
+	var err error
+	switch {
+	case p.keyFile != nil:
+		err = p.keyFile.Err()
+	case p.keyFetch != nil:
+		err = p.keyFetch.Err()
+	}
+	return map[string]error{"oidc/" + p.issuer: err}
+}
+
+// keyFetch records the outcome of the last request for a discovered issuer's JWKS.
+type keyFetch struct {
+	client *http.Client
+	next   http.RoundTripper
+
+	mu  sync.RWMutex
+	err error
+}
+
+// newKeyFetch wraps the context's client, as set by oidc.ClientContext.
+func newKeyFetch(ctx context.Context) *keyFetch {
+	client := http.DefaultClient
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+	f := &keyFetch{next: client.Transport}
+	if f.next == nil {
+		f.next = http.DefaultTransport
+	}
+	f.client = &http.Client{Transport: f, Timeout: client.Timeout}
+	return f
+}
+
+func (f *keyFetch) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := f.next.RoundTrip(req)
+	var fetchErr error
+	switch {
+	case err != nil:
+		fetchErr = fmt.Errorf("fetching keys: %w", err)
+	case resp.StatusCode != http.StatusOK:
+		fetchErr = fmt.Errorf("fetching keys: unexpected status %d", resp.StatusCode)
+	}
+	f.mu.Lock()
+	f.err = fetchErr
+	f.mu.Unlock()
+	return resp, err
+}
+
+// Err returns the error of the last request for keys, while previously fetched keys are still used.
+func (f *keyFetch) Err() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.err
+}
+
 func (p *TokenParser) Parse(ctx context.Context, tok string) (api.Claims, error) {
+	start := time.Now()
+	claims, err := p.parse(ctx, tok)
+	metrics.OIDCVerifyDuration.WithLabelValues(p.issuer, metrics.Result(err)).Observe(time.Since(start).Seconds())
+	return claims, err
+}
+
+func (p *TokenParser) parse(ctx context.Context, tok string) (api.Claims, error) {
 	parsed, err := p.verifier.Verify(ctx, tok)
 	if err != nil {
 		return nil, fmt.Errorf("verifying token: %w", err)
 	}
+	if err := p.checkAudience(parsed.Audience); err != nil {
+		return nil, err
+	}
 	var claims api.Claims
 	if err := parsed.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("parsing claims: %w", err)
 	}
 	return claims, nil
 }
+
+func (p *TokenParser) checkAudience(audiences []string) error {
+	if p.allowAnyAudience {
+		return nil
+	}
+	for _, aud := range audiences {
+		if _, ok := p.audiences[aud]; ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("token audience %q not accepted", audiences)
+}
@@ -24,7 +24,7 @@ func TestTokenParser_Actions(t *testing.T) {
 	ctx := context.Background()
 	ghTokenWasValid, err := time.Parse(time.RFC3339, "2022-07-15T11:26:30Z")
 	require.NoError(t, err)
-	tp, err := oidc.NewTokenParser(ctx, issuerGitHub, freezeTime(ghTokenWasValid))
+	tp, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: issuerGitHub, AllowAnyAudience: true}, freezeTime(ghTokenWasValid))
 	require.NoError(t, err)
 
 	claims, err := tp.Parse(ctx, ghToken)
@@ -37,9 +37,80 @@ func TestTokenParser_Actions(t *testing.T) {
 	assert.Equal(t, "Hack", claims["workflow"])
 }
 
+func TestTokenParser_Audience(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+
+	cases := map[string]struct {
+		audiences []string
+		allowAny  bool
+		aud       interface{}
+		ok        bool
+	}{
+		"allow any":         {allowAny: true, aud: "anything", ok: true},
+		"matching":          {audiences: []string{"gtfo"}, aud: "gtfo", ok: true},
+		"one of many":       {audiences: []string{"gtfo", "sigstore"}, aud: "sigstore", ok: true},
+		"multiple in token": {audiences: []string{"gtfo"}, aud: []string{"other", "gtfo"}, ok: true},
+		"mismatch":          {audiences: []string{"gtfo"}, aud: "other"},
+		"missing":           {audiences: []string{"gtfo"}},
+	}
+	for label, tc := range cases {
+		tc := tc
+		t.Run(label, func(t *testing.T) {
+			t.Parallel()
+			tp, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: iss.URL, Audiences: tc.audiences, AllowAnyAudience: tc.allowAny})
+			require.NoError(t, err)
+
+			claims := map[string]interface{}{}
+			if tc.aud != nil {
+				claims["aud"] = tc.aud
+			}
+			parsed, err := tp.Parse(ctx, iss.token(t, claims))
+			if tc.ok {
+				require.NoError(t, err)
+				assert.Equal(t, iss.URL, parsed["iss"])
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTokenParser_NoAudiences(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+
+	_, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: iss.URL})
+	assert.ErrorContains(t, err, "allow_any_audience")
+	_, err = oidc.NewParser(ctx, oidc.IssuerConfig{Issuer: iss.URL + "/{enterprise}"})
+	assert.ErrorContains(t, err, "allow_any_audience")
+}
+
 // I'd stop the world and verify tokens with you
 func freezeTime(t time.Time) oidc.TokenParserOpt {
 	return func(cfg *coreoidc.Config) {
 		cfg.Now = func() time.Time { return t }
 	}
 }
+
+func TestTokenParser_CheckHealth(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	tp, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: iss.URL, AllowAnyAudience: true})
+	require.NoError(t, err)
+	assert.NoError(t, tp.CheckHealth(ctx)["oidc/"+iss.URL])
+
+	// Keys are fetched when a token is verified:
+	iss.keysUnavailable.Store(true)
+	_, err = tp.Parse(ctx, iss.token(t, nil))
+	require.Error(t, err)
+	assert.ErrorContains(t, tp.CheckHealth(ctx)["oidc/"+iss.URL], "fetching keys")
+
+	iss.keysUnavailable.Store(false)
+	_, err = tp.Parse(ctx, iss.token(t, nil))
+	require.NoError(t, err)
+	assert.NoError(t, tp.CheckHealth(ctx)["oidc/"+iss.URL])
+}
@@ -0,0 +1,53 @@
+package oidc
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// issuerPattern matches issuers by path, like `https://token.actions.githubusercontent.com/{enterprise}`.
+// Path segments that are `*` or a `{name}` match any single segment, the scheme and host must match exactly.
+type issuerPattern struct {
+	config IssuerConfig
+	re     *regexp.Regexp
+}
+
+// isIssuerPattern returns true if the issuer has wildcard segments.
+func isIssuerPattern(issuer string) bool {
+	return strings.ContainsAny(issuer, "*{")
+}
+
+func newIssuerPattern(cfg IssuerConfig) (*issuerPattern, error) {
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer pattern: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" || isIssuerPattern(u.Host) {
+		return nil, fmt.Errorf("issuer pattern %q must have a literal scheme and host", cfg.Issuer)
+	}
+
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		if seg == "*" || (strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}")) {
+			segments[i] = "[^/]+"
+		} else if isIssuerPattern(seg) {
+			return nil, fmt.Errorf("issuer pattern %q has an invalid segment %q", cfg.Issuer, seg)
+		} else {
+			segments[i] = regexp.QuoteMeta(seg)
+		}
+	}
+	expr := "^" + regexp.QuoteMeta(u.Scheme+"://"+u.Host) + strings.Join(segments, "/") + "$"
+	return &issuerPattern{config: cfg, re: regexp.MustCompile(expr)}, nil
+}
+
+// match returns the config of a concrete issuer matching the pattern.
+func (p *issuerPattern) match(issuer string) (IssuerConfig, bool) {
+	if !p.re.MatchString(issuer) {
+		return IssuerConfig{}, false
+	}
+	cfg := p.config
+	cfg.Issuer = issuer
+	return cfg, true
+}
@@ -0,0 +1,113 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thepwagner/github-token-factory-oidc/api"
+)
+
+// ErrTokenReplayed is returned when a token is presented more than once.
+var ErrTokenReplayed = errors.New("token has already been used")
+
+// ReplayStore remembers tokens that have been presented.
+type ReplayStore interface {
+	// Seen records a token until it expires, returning true if it was already recorded.
+	Seen(ctx context.Context, key string, expires time.Time) (bool, error)
+	// Forget drops a recorded token, so it can be presented again.
+	Forget(ctx context.Context, key string) error
+}
+
+// ReplayGuard is an api.ReplayGuard that only lets each token be exchanged once.
+type ReplayGuard struct {
+	store ReplayStore
+}
+
+var _ api.ReplayGuard = (*ReplayGuard)(nil)
+
+func NewReplayGuard(store ReplayStore) *ReplayGuard {
+	return &ReplayGuard{store: store}
+}
+
+func (g *ReplayGuard) Consume(ctx context.Context, tok string, claims api.Claims) error {
+	seen, err := g.store.Seen(ctx, replayKey(claims, tok), replayExpiry(claims))
+	if err != nil {
+		return fmt.Errorf("checking token replay: %w", err)
+	} else if seen {
+		return ErrTokenReplayed
+	}
+	return nil
+}
+
+func (g *ReplayGuard) Release(ctx context.Context, tok string, claims api.Claims) error {
+	if err := g.store.Forget(ctx, replayKey(claims, tok)); err != nil {
+		return fmt.Errorf("forgetting token: %w", err)
+	}
+	return nil
+}
+
+// replayKey identifies a token by its issuer and ID, or its hash if it doesn't have an ID.
+func replayKey(claims api.Claims, tok string) string {
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		iss, _ := claims["iss"].(string)
+		return fmt.Sprintf("%s#%s", iss, jti)
+	}
+	h := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(h[:])
+}
+
+// replayExpiry is how long a token must be remembered: until the issuer would no longer accept it.
+func replayExpiry(claims api.Claims) time.Time {
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0)
+	}
+	return time.Now().Add(time.Hour)
+}
+
+// MemoryReplayStore is a ReplayStore for a single server.
+type MemoryReplayStore struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+var _ ReplayStore = (*MemoryReplayStore)(nil)
+
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return &MemoryReplayStore{
+		seen: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryReplayStore) Seen(_ context.Context, key string, expires time.Time) (bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, exp := range s.seen {
+			if now.After(exp) {
+				delete(s.seen, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if exp, ok := s.seen[key]; ok && now.Before(exp) {
+		return true, nil
+	}
+	s.seen[key] = expires
+	return false, nil
+}
+
+func (s *MemoryReplayStore) Forget(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.seen, key)
+	return nil
+}
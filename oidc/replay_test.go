@@ -0,0 +1,53 @@
+package oidc_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/oidc"
+)
+
+func TestReplayGuard(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	tp, err := oidc.NewTokenParser(ctx, oidc.IssuerConfig{Issuer: iss.URL, AllowAnyAudience: true})
+	require.NoError(t, err)
+	guard := oidc.NewReplayGuard(oidc.NewMemoryReplayStore())
+	consume := func(tok string) error {
+		claims, err := tp.Parse(ctx, tok)
+		require.NoError(t, err)
+		return guard.Consume(ctx, tok, claims)
+	}
+
+	t.Run("by jti", func(t *testing.T) {
+		t.Parallel()
+		tok := iss.token(t, map[string]interface{}{"jti": "4b32ea12-bd60-4481-96a8-0d56817b2284"})
+		require.NoError(t, consume(tok))
+		assert.ErrorIs(t, consume(tok), oidc.ErrTokenReplayed)
+
+		// A different token with the same ID is still a replay:
+		tok = iss.token(t, map[string]interface{}{"jti": "4b32ea12-bd60-4481-96a8-0d56817b2284", "sub": "other"})
+		assert.ErrorIs(t, consume(tok), oidc.ErrTokenReplayed)
+	})
+
+	t.Run("by hash", func(t *testing.T) {
+		t.Parallel()
+		tok := iss.token(t, map[string]interface{}{"sub": "no-jti"})
+		require.NoError(t, consume(tok))
+		assert.ErrorIs(t, consume(tok), oidc.ErrTokenReplayed)
+	})
+
+	t.Run("released tokens can be consumed again", func(t *testing.T) {
+		t.Parallel()
+		tok := iss.token(t, map[string]interface{}{"jti": "c0ffee"})
+		claims, err := tp.Parse(ctx, tok)
+		require.NoError(t, err)
+		require.NoError(t, guard.Consume(ctx, tok, claims))
+		require.NoError(t, guard.Release(ctx, tok, claims))
+		require.NoError(t, guard.Consume(ctx, tok, claims))
+		assert.ErrorIs(t, guard.Consume(ctx, tok, claims), oidc.ErrTokenReplayed)
+	})
+}
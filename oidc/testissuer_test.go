@@ -0,0 +1,95 @@
+package oidc_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer is a local OIDC issuer that signs tokens with a generated key.
+// Discovery is served under any path, so the server can act as many issuers.
+type testIssuer struct {
+	*httptest.Server
+	key         *rsa.PrivateKey
+	discoveries atomic.Int32
+	// failures is the number of discovery requests to fail before succeeding.
+	failures atomic.Int32
+	// If set, requests for the JWKS fail.
+	keysUnavailable atomic.Bool
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	iss := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		prefix, ok := strings.CutSuffix(r.URL.Path, "/.well-known/openid-configuration")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		iss.discoveries.Add(1)
+		if iss.failures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                iss.URL + prefix,
+			"jwks_uri":                              iss.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		if iss.keysUnavailable.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(iss.jwks())
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (i *testIssuer) jwks() jose.JSONWebKeySet {
+	return jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: &i.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}},
+	}
+}
+
+// token signs a token for the given claims, defaulting the issuer and validity.
+func (i *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	now := time.Now()
+	payload := map[string]interface{}{
+		"iss": i.URL,
+		"sub": "repo:thepwagner/github-token-action:ref:refs/heads/main",
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		payload[k] = v
+	}
+	payloadJSON, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: i.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	require.NoError(t, err)
+	signed, err := signer.Sign(payloadJSON)
+	require.NoError(t, err)
+	tok, err := signed.CompactSerialize()
+	require.NoError(t, err)
+	return tok
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/thepwagner/github-token-factory-oidc/github"
+)
+
+// Admin serves operator endpoints, authenticated by a shared token.
+type Admin struct {
+	log     *slog.Logger
+	token   string
+	clients *github.Clients
+}
+
+func NewAdmin(log *slog.Logger, token string, clients *github.Clients) *Admin {
+	return &Admin{
+		log:     log.With("logger", "Admin"),
+		token:   token,
+		clients: clients,
+	}
+}
+
+// FlushClients evicts the cached GitHub clients of an owner.
+func (a *Admin) FlushClients(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	owner := r.PathValue("owner")
+	a.clients.Evict(owner)
+	a.log.Info("flushed github clients", "owner", owner)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(a.token)) == 1
+}
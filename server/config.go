@@ -3,20 +3,36 @@ package server
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"github.com/thepwagner/github-token-factory-oidc/audit"
 	"github.com/thepwagner/github-token-factory-oidc/github"
+	"github.com/thepwagner/github-token-factory-oidc/oidc"
 )
 
 type Config struct {
 	Addr    string
-	Issuers []string
-	Checker CheckerConfig
-	GitHub  map[string]github.Config
+	Issuers []oidc.IssuerConfig
+	// If set, each OIDC token is only exchanged for one GitHub token. It can still revoke and explain.
+	ReplayProtection bool `mapstructure:"replay_protection"`
+	Checker          CheckerConfig
+	GitHub           map[string]github.Config
+	// How long GitHub installations are cached, 0 caches them until they're evicted.
+	GitHubClientTTL time.Duration `mapstructure:"github_client_ttl"`
+	// If set, admin endpoints are served to clients presenting this bearer token.
+	AdminToken string `mapstructure:"admin_token"`
+	Tracing    TracingConfig
+	Log        LogConfig
+	Audit      audit.Config
 }
 
 type CheckerConfig struct {
-	Rego *RegoConfig
+	Rego  *RegoConfig
+	Local *LocalConfig
 }
 
 type RegoConfig struct {
@@ -24,15 +40,38 @@ type RegoConfig struct {
 	OwnerRepo string `mapstructure:"owner_repo"`
 	// If set, `.github/tokens.rego` will be loaded from every repository in a request.
 	FromRepos bool
+	// Maximum number of compiled policies to cache, 0 disables caching.
+	CacheSize int `mapstructure:"cache_size"`
+	// How long a cached policy may be revalidated before it is fetched again.
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+}
+
+// LocalConfig loads policies from the local filesystem instead of repositories.
+// Policies are still layered as configured by RegoConfig.
+type LocalConfig struct {
+	// Directory of policies, or OPA bundle tarball. The policy of `owner/repo` is `owner/repo.rego`.
+	Path string
 }
 
 // NewConfig loads config from the current directory.
 func NewConfig() (*Config, error) {
+	return NewConfigFromDir(".")
+}
+
+// NewConfigFromDir loads config from `gtfo.yaml` (or another supported extension) in dir.
+func NewConfigFromDir(dir string) (*Config, error) {
 	v := viper.New()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
-	v.AddConfigPath(".")
+	v.AddConfigPath(dir)
 	v.SetConfigName("gtfo")
 	v.SetDefault("checker.rego.owner_repo", ".github")
+	v.SetDefault("checker.rego.cache_size", 1000)
+	v.SetDefault("checker.rego.cache_ttl", time.Hour)
+	v.SetDefault("tracing.sample_ratio", 1.0)
+	v.SetDefault("github_client_ttl", time.Hour)
+	v.SetDefault("log.level", "debug")
+	v.SetDefault("log.format", "text")
 
 	if err := v.ReadInConfig(); err != nil {
 		var nfe viper.ConfigFileNotFoundError
@@ -42,8 +81,21 @@ func NewConfig() (*Config, error) {
 	}
 
 	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		issuerDecodeHook,
+	))
+	if err := v.Unmarshal(&cfg, decodeHook); err != nil {
 		return nil, fmt.Errorf("unmarshaling config: %w", err)
 	}
 	return &cfg, nil
 }
+
+// issuerDecodeHook allows issuers to be configured by URL alone.
+func issuerDecodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(oidc.IssuerConfig{}) {
+		return data, nil
+	}
+	return oidc.IssuerConfig{Issuer: data.(string)}, nil
+}
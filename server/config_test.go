@@ -1,10 +1,13 @@
 package server_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/oidc"
 	"github.com/thepwagner/github-token-factory-oidc/server"
 )
 
@@ -14,4 +17,25 @@ func TestNewConfig(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, ".github", c.Checker.Rego.OwnerRepo)
 	assert.Equal(t, false, c.Checker.Rego.FromRepos)
+	assert.Equal(t, 1000, c.Checker.Rego.CacheSize)
+	assert.Equal(t, time.Hour, c.Checker.Rego.CacheTTL)
+	assert.Equal(t, "debug", c.Log.Level)
+	assert.Equal(t, "text", c.Log.Format)
+	assert.Equal(t, time.Hour, c.GitHubClientTTL)
+}
+
+func TestNewConfigFromDir_Example(t *testing.T) {
+	t.Parallel()
+	c, err := server.NewConfigFromDir("..")
+	require.NoError(t, err)
+	require.NotEmpty(t, c.Issuers)
+	for _, issuer := range c.Issuers {
+		assert.NotEmpty(t, issuer.Audiences, issuer.Issuer)
+	}
+
+	// Issuers are validated before they're discovered, a cancelled context skips discovery:
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = oidc.NewParser(ctx, c.Issuers...)
+	require.NoError(t, err)
 }
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lmittmann/tint"
+)
+
+type LogConfig struct {
+	// Minimum level to log: debug, info, warn or error.
+	Level string
+	// Either "text" for colored output, or "json" for log pipelines.
+	Format string
+}
+
+// NewLogger builds a logger writing to w.
+func NewLogger(cfg LogConfig, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("parsing log level: %w", err)
+	}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		return slog.New(tint.NewHandler(w, &tint.Options{
+			Level:      level,
+			TimeFormat: time.RFC3339,
+		})), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: level,
+		})), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+}
@@ -0,0 +1,38 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/server"
+)
+
+func TestNewLogger_JSON(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	log, err := server.NewLogger(server.LogConfig{Level: "info", Format: "json"}, &buf)
+	require.NoError(t, err)
+
+	log.Debug("hidden")
+	log.Info("evaluated repo policy", "repository", "thepwagner/gtfo", "policy_sha", "abc123")
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "INFO", line["level"])
+	assert.Equal(t, "evaluated repo policy", line["msg"])
+	assert.Equal(t, "thepwagner/gtfo", line["repository"])
+	assert.Equal(t, "abc123", line["policy_sha"])
+}
+
+func TestNewLogger_Invalid(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+
+	_, err := server.NewLogger(server.LogConfig{Level: "loud"}, &buf)
+	assert.Error(t, err)
+	_, err = server.NewLogger(server.LogConfig{Level: "info", Format: "xml"}, &buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/metrics"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewRouter routes requests to the API, health and metrics handlers.
+// Admin and GitHub webhook handlers are routed if they are non-nil.
+// Routes use the method and wildcard patterns of Go 1.22's ServeMux.
+func NewRouter(tp trace.TracerProvider, handler *api.Handler, health *api.Health, admin *Admin, webhooks http.Handler) http.Handler {
+	r := router{ServeMux: http.NewServeMux(), tp: tp}
+
+	r.api("POST", "/v1/token", handler.Issue)
+	r.api("POST", "/v1/revoke", handler.Revoke)
+	r.api("POST", "/v1/explain", handler.Explain)
+	r.api("POST", "/oauth/token", handler.Exchange)
+	if webhooks != nil {
+		r.api("POST", "/v1/webhooks/github", webhooks.ServeHTTP)
+	}
+
+	r.route("GET", "/healthz", health.Live)
+	r.route("GET", "/readyz", health.Ready)
+	r.route("GET", "/metrics", metrics.Handler().ServeHTTP)
+
+	if admin != nil {
+		r.route("DELETE", "/admin/github/clients/{owner}", admin.FlushClients)
+	}
+
+	// Unversioned routes, for existing clients:
+	r.Handle("/{$}", r.traced("/", handler))
+	r.api("POST", "/explain", handler.Explain)
+
+	r.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	})
+	return r
+}
+
+type router struct {
+	*http.ServeMux
+	tp trace.TracerProvider
+}
+
+// route handles a method and path, and rejects other methods for the path.
+func (r router) route(method, path string, handler http.HandlerFunc) {
+	r.HandleFunc(method+" "+path, handler)
+	r.HandleFunc(path, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+}
+
+// api routes a traced API handler.
+func (r router) api(method, path string, handler http.HandlerFunc) {
+	r.route(method, path, r.traced(path, handler).ServeHTTP)
+}
+
+func (r router) traced(operation string, handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, operation, otelhttp.WithTracerProvider(r.tp))
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
@@ -0,0 +1,191 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/github"
+	"github.com/thepwagner/github-token-factory-oidc/oidc"
+	"github.com/thepwagner/github-token-factory-oidc/server"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type stubParser struct{}
+
+func (stubParser) Parse(context.Context, string) (api.Claims, error) {
+	return api.Claims{"iss": "https://issuer.example", "sub": "test"}, nil
+}
+
+type stubChecker struct{}
+
+func (stubChecker) Check(context.Context, api.Claims, *api.TokenRequest) (*api.Decision, error) {
+	return &api.Decision{Allowed: true}, nil
+}
+
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	return newTestRouterWithGuard(t, nil)
+}
+
+func newTestRouterWithGuard(t *testing.T, replayGuard api.ReplayGuard) http.Handler {
+	t.Helper()
+	tp := noop.NewTracerProvider()
+	issuer := func(_ context.Context, req *api.TokenRequest) (*api.IssuedToken, error) {
+		return &api.IssuedToken{Token: "ghs_test", Repositories: req.Repositories, Permissions: req.Permissions}, nil
+	}
+	revoker := func(context.Context, string, string) error { return nil }
+	handler := api.NewHandler(slog.Default(), tp.Tracer(""), stubParser{}, stubChecker{}, issuer, revoker, api.WithReplayGuard(replayGuard))
+	return server.NewRouter(tp, handler, api.NewHealth(), nil, nil)
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+	router := newTestRouter(t)
+	const tokenRequest = `{"repositories":["thepwagner/gtfo"],"permissions":{"contents":"read"}}`
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		contains           string
+	}{
+		{method: "POST", path: "/v1/token", body: tokenRequest, status: http.StatusOK, contains: "ghs_test"},
+		{method: "POST", path: "/v1/explain", body: tokenRequest, status: http.StatusOK, contains: `"allowed":true`},
+		{method: "POST", path: "/v1/revoke", body: `{"token":"ghs_test"}`, status: http.StatusOK, contains: `"revoked":true`},
+		{method: "GET", path: "/v1/token", status: http.StatusMethodNotAllowed, contains: `"error":"method not allowed"`},
+		{method: "GET", path: "/healthz", status: http.StatusOK, contains: `"status":"ok"`},
+		{method: "GET", path: "/readyz", status: http.StatusOK, contains: `"status":"ok"`},
+		{method: "GET", path: "/metrics", status: http.StatusOK},
+		{method: "POST", path: "/", body: tokenRequest, status: http.StatusOK, contains: "ghs_test"},
+		{method: "GET", path: "/", status: http.StatusMethodNotAllowed, contains: `"error":"method not allowed"`},
+		{method: "POST", path: "/explain", body: tokenRequest, status: http.StatusOK, contains: `"allowed":true`},
+		{method: "POST", path: "/v2/token", body: tokenRequest, status: http.StatusNotFound, contains: `"error":"not found"`},
+		{method: "GET", path: "/favicon.ico", status: http.StatusNotFound, contains: `"error":"not found"`},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer test")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.status, rec.Code)
+			assert.Contains(t, rec.Body.String(), tc.contains)
+			if tc.path != "/metrics" {
+				var body map[string]interface{}
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+			}
+		})
+	}
+}
+
+func TestRouter_ReplayProtection(t *testing.T) {
+	t.Parallel()
+	router := newTestRouterWithGuard(t, oidc.NewReplayGuard(oidc.NewMemoryReplayStore()))
+	const tokenRequest = `{"repositories":["thepwagner/gtfo"],"permissions":{"contents":"read"}}`
+	serve := func(path, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer oidc-jwt")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/v1/explain", tokenRequest))
+	assert.Equal(t, http.StatusOK, serve("/v1/token", tokenRequest))
+	// The token that was exchanged can still revoke, but not be exchanged again:
+	assert.Equal(t, http.StatusOK, serve("/v1/revoke", `{"token":"ghs_test"}`))
+	assert.Equal(t, http.StatusUnauthorized, serve("/v1/token", tokenRequest))
+}
+
+func TestRouter_Exchange(t *testing.T) {
+	t.Parallel()
+	router := newTestRouter(t)
+
+	exchange := func(form url.Values) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+	valid := func() url.Values {
+		return url.Values{
+			"grant_type":         {api.GrantTypeTokenExchange},
+			"subject_token":      {"oidc-jwt"},
+			"subject_token_type": {api.TokenTypeJWT},
+			"scope":              {"contents:read issues:write"},
+			"resource":           {"thepwagner/gtfo", "https://github.com/thepwagner/github-token-factory-oidc"},
+		}
+	}
+
+	status, body := exchange(valid())
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ghs_test", body["access_token"])
+	assert.Equal(t, api.TokenTypeAccessToken, body["issued_token_type"])
+	assert.Equal(t, "Bearer", body["token_type"])
+	assert.Equal(t, "contents:read issues:write", body["scope"])
+
+	cases := map[string]struct {
+		modify func(url.Values)
+		code   string
+	}{
+		"grant type":  {modify: func(v url.Values) { v.Set("grant_type", "client_credentials") }, code: "unsupported_grant_type"},
+		"token type":  {modify: func(v url.Values) { v.Set("subject_token_type", api.TokenTypeAccessToken) }, code: "invalid_request"},
+		"no token":    {modify: func(v url.Values) { v.Del("subject_token") }, code: "invalid_request"},
+		"bad scope":   {modify: func(v url.Values) { v.Set("scope", "contents") }, code: "invalid_scope"},
+		"bad target":  {modify: func(v url.Values) { v.Set("resource", "gtfo") }, code: "invalid_target"},
+		"no resource": {modify: func(v url.Values) { v.Del("resource") }, code: "invalid_request"},
+	}
+	for label, tc := range cases {
+		form := valid()
+		tc.modify(form)
+		status, body := exchange(form)
+		assert.Equal(t, http.StatusBadRequest, status, label)
+		assert.Equal(t, tc.code, body["error"], label)
+		assert.NotEmpty(t, body["error_description"], label)
+	}
+}
+
+func TestRouter_Admin(t *testing.T) {
+	t.Parallel()
+	tp := noop.NewTracerProvider()
+	handler := api.NewHandler(slog.Default(), tp.Tracer(""), stubParser{}, stubChecker{}, nil, nil)
+	clients, err := github.NewClients(context.Background(), slog.Default(), http.DefaultTransport, nil, 0)
+	require.NoError(t, err)
+	admin := server.NewAdmin(slog.Default(), "s3cret", clients)
+	router := server.NewRouter(tp, handler, api.NewHealth(), admin, nil)
+
+	for auth, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"s3cret":        http.StatusUnauthorized,
+		"Bearer s3cret": http.StatusNoContent,
+	} {
+		req := httptest.NewRequest("DELETE", "/admin/github/clients/thepwagner", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, auth)
+	}
+
+	// Admin routes aren't served without a token:
+	rec := httptest.NewRecorder()
+	newTestRouter(t).ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/github/clients/thepwagner", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
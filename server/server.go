@@ -10,22 +10,16 @@ import (
 
 	coreoidc "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/thepwagner/github-token-factory-oidc/api"
+	"github.com/thepwagner/github-token-factory-oidc/audit"
 	"github.com/thepwagner/github-token-factory-oidc/checker"
 	"github.com/thepwagner/github-token-factory-oidc/github"
 	"github.com/thepwagner/github-token-factory-oidc/oidc"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
 )
 
-func Run(ctx context.Context, log *slog.Logger) error {
-	cfg, err := NewConfig()
-	if err != nil {
-		return fmt.Errorf("loading configuration: %w", err)
-	}
-	tp, err := newTracerProvider()
+func Run(ctx context.Context, log *slog.Logger, cfg *Config) error {
+	tp, err := NewTracerProvider(ctx, cfg.Tracing)
 	if err != nil {
 		return fmt.Errorf("building tracer: %w", err)
 	}
@@ -44,6 +38,11 @@ func Run(ctx context.Context, log *slog.Logger) error {
 		Transport: otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithTracerProvider(tp)),
 	}
 
+	for _, issuer := range cfg.Issuers {
+		if issuer.AllowAnyAudience {
+			log.Warn("issuer audience will not be checked", "issuer", issuer.Issuer)
+		}
+	}
 	parser, err := oidc.NewParser(coreoidc.ClientContext(ctx, tracedClient), cfg.Issuers...)
 	if err != nil {
 		span.RecordError(err)
@@ -51,27 +50,87 @@ func Run(ctx context.Context, log *slog.Logger) error {
 		span.End()
 		return fmt.Errorf("failed to create OIDC parser: %w", err)
 	}
+	health := []api.HealthChecker{}
+	if hc, ok := parser.(api.HealthChecker); ok {
+		// An unavailable issuer only rejects its own tokens:
+		health = append(health, api.Degradable(hc))
+	}
+	var replayGuard api.ReplayGuard
+	if cfg.ReplayProtection {
+		replayGuard = oidc.NewReplayGuard(oidc.NewMemoryReplayStore())
+	}
 	parser = oidc.NewTracedTokenParser(tp, parser)
 
-	ghClients := github.NewClients(tracedClient.Transport, cfg.GitHub)
-	authz := checker.NewRepoRego(log, ghClients, cfg.Checker.Rego.OwnerRepo, cfg.Checker.Rego.FromRepos)
+	ghClients, err := github.NewClients(ctx, log, tracedClient.Transport, cfg.GitHub, cfg.GitHubClientTTL)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return fmt.Errorf("failed to create GitHub clients: %w", err)
+	}
+	health = append(health, ghClients)
+	policies, err := newPolicySource(ctx, log, cfg.Checker, ghClients)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return fmt.Errorf("failed to load policies: %w", err)
+	}
+	authz := checker.NewRepoRego(log, policies, cfg.Checker.Rego.OwnerRepo, cfg.Checker.Rego.FromRepos)
 
 	issuer := github.NewIssuer(log, tracer, ghClients)
 
-	handler := api.NewHandler(log, tracer, parser, authz, issuer.IssueToken)
-	traced := otelhttp.NewHandler(handler, "ServeHTTP", otelhttp.WithTracerProvider(tp))
+	auditSink, err := audit.NewSink(log, cfg.Audit, tracedClient)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return fmt.Errorf("failed to create audit sink: %w", err)
+	}
+	if closer, ok := auditSink.(audit.Closer); ok {
+		defer func() {
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := closer.Close(flushCtx); err != nil {
+				log.Error("failed to flush audit events", slog.String("err", err.Error()))
+			}
+		}()
+	}
+
+	handler := api.NewHandler(log, tracer, parser, authz, issuer.IssueToken, issuer.RevokeToken,
+		api.WithAuditSink(auditSink), api.WithReplayGuard(replayGuard), api.WithGitHubInstances(ghClients))
+	var admin *Admin
+	if cfg.AdminToken != "" {
+		admin = NewAdmin(log, cfg.AdminToken, ghClients)
+	}
+	router := NewRouter(tp, handler, api.NewHealth(health...), admin, newWebhookHandler(log, ghClients, policies))
 	span.End()
-	return runServer(ctx, log, cfg.Addr, traced)
+	return runServer(ctx, log, cfg.Addr, router)
 }
 
-func newTracerProvider() (*sdktrace.TracerProvider, error) {
-	tpOptions := []sdktrace.TracerProviderOption{
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String("gtfo"),
-		)),
-	}
-	return sdktrace.NewTracerProvider(tpOptions...), nil
+func newPolicySource(ctx context.Context, log *slog.Logger, cfg CheckerConfig, ghClients *github.Clients) (checker.PolicySource, error) {
+	if cfg.Local != nil && cfg.Local.Path != "" {
+		return checker.NewLocalPolicySource(ctx, log, cfg.Local.Path)
+	}
+
+	var cache *checker.PolicyCache
+	if cfg.Rego.CacheSize > 0 {
+		cache = checker.NewPolicyCache(cfg.Rego.CacheSize, cfg.Rego.CacheTTL)
+	}
+	return checker.NewGitHubPolicySource(log, ghClients, cache), nil
+}
+
+// newWebhookHandler returns a handler for GitHub webhooks, or nil if no app has a webhook secret.
+func newWebhookHandler(log *slog.Logger, ghClients *github.Clients, policies checker.PolicySource) http.Handler {
+	var invalidate func(repo string)
+	if source, ok := policies.(*checker.GitHubPolicySource); ok {
+		invalidate = source.Invalidate
+	}
+	webhooks := github.NewWebhookHandler(log, ghClients, checker.PolicyPath, invalidate)
+	if !webhooks.Enabled() {
+		return nil
+	}
+	return webhooks
 }
 
 func runServer(ctx context.Context, log *slog.Logger, addr string, handler http.Handler) error {
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"google.golang.org/grpc/credentials"
+)
+
+type TracingConfig struct {
+	// Exporter is "otlp", "stdout", or empty to discard spans.
+	Exporter string
+	// OTLP protocol, "grpc" or "http/protobuf" (the default).
+	Protocol string
+	// OTLP endpoint, e.g. `http://localhost:4318` for HTTP or `http://localhost:4317` for gRPC.
+	// Defaults to the standard OTEL_EXPORTER_OTLP_* environment variables.
+	Endpoint string
+	// Headers sent with every OTLP request, e.g. for authentication.
+	Headers map[string]string
+	// TLS for https endpoints.
+	TLS TracingTLSConfig
+	// Compression of OTLP requests, "gzip" or empty for none.
+	Compression string
+	// Fraction of new traces to sample, between 0 and 1.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+	// Attributes added to the resource of every span.
+	Attributes map[string]string
+}
+
+type TracingTLSConfig struct {
+	// PEM file of CAs to verify the collector with, instead of the system roots.
+	CA string
+	// PEM files of a client certificate and key, for mutual TLS.
+	Cert string
+	Key  string
+}
+
+// NewTracerProvider builds a tracer provider that exports spans as configured.
+func NewTracerProvider(ctx context.Context, cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String("gtfo")}
+	for k, v := range cfg.Attributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	tpOptions := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	}
+
+	switch cfg.Exporter {
+	case "":
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("creating stdout exporter: %w", err)
+		}
+		tpOptions = append(tpOptions, sdktrace.WithBatcher(exporter))
+	case "otlp":
+		exporter, err := newOTLPExporter(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating otlp exporter: %w", err)
+		}
+		tpOptions = append(tpOptions, sdktrace.WithBatcher(exporter))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	return sdktrace.NewTracerProvider(tpOptions...), nil
+}
+
+func newOTLPExporter(ctx context.Context, cfg TracingConfig) (sdktrace.SpanExporter, error) {
+	if cfg.Endpoint != "" {
+		if u, err := url.Parse(cfg.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q", cfg.Endpoint)
+		}
+	}
+	switch cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, fmt.Errorf("unknown compression %q", cfg.Compression)
+	}
+	tlsConfig, err := cfg.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Protocol {
+	case "", "http/protobuf":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		if tlsConfig != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		if cfg.Compression == "gzip" {
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+		}
+		if tlsConfig != nil {
+			opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		if cfg.Compression == "gzip" {
+			opts = append(opts, otlptracegrpc.WithCompressor("gzip"))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown otlp protocol %q", cfg.Protocol)
+	}
+}
+
+// config returns the TLS configuration, or nil to use the exporter's default.
+func (c TracingTLSConfig) config() (*tls.Config, error) {
+	if c.CA == "" && c.Cert == "" && c.Key == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in tls ca %q", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
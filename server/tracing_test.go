@@ -0,0 +1,128 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/github-token-factory-oidc/server"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewTracerProvider_OTLP(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan *tracepb.TracesData, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var traces tracepb.TracesData
+		assert.NoError(t, proto.Unmarshal(body, &traces))
+		received <- &traces
+	}))
+	defer collector.Close()
+
+	ctx := context.Background()
+	tp, err := server.NewTracerProvider(ctx, server.TracingConfig{
+		Exporter:    "otlp",
+		Endpoint:    collector.URL,
+		Headers:     map[string]string{"authorization": "Bearer secret"},
+		SampleRatio: 1,
+		Attributes:  map[string]string{"deployment.environment": "test"},
+	})
+	require.NoError(t, err)
+
+	_, span := tp.Tracer("").Start(ctx, "IssueToken")
+	span.End()
+	require.NoError(t, tp.Shutdown(ctx))
+
+	traces := <-received
+	require.Len(t, traces.GetResourceSpans(), 1)
+	rs := traces.GetResourceSpans()[0]
+	attrs := make(map[string]string)
+	for _, kv := range rs.GetResource().GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	assert.Equal(t, "gtfo", attrs["service.name"])
+	assert.Equal(t, "test", attrs["deployment.environment"])
+	require.Len(t, rs.GetScopeSpans(), 1)
+	require.Len(t, rs.GetScopeSpans()[0].GetSpans(), 1)
+	assert.Equal(t, "IssueToken", rs.GetScopeSpans()[0].GetSpans()[0].GetName())
+}
+
+func TestNewTracerProvider_Invalid(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	_, err := server.NewTracerProvider(ctx, server.TracingConfig{Exporter: "jaeger"})
+	assert.Error(t, err)
+	_, err = server.NewTracerProvider(ctx, server.TracingConfig{Exporter: "otlp", Protocol: "thrift"})
+	assert.Error(t, err)
+	_, err = server.NewTracerProvider(ctx, server.TracingConfig{Exporter: "otlp", Endpoint: "localhost"})
+	assert.Error(t, err)
+	_, err = server.NewTracerProvider(ctx, server.TracingConfig{Exporter: "otlp", Compression: "zstd"})
+	assert.Error(t, err)
+	_, err = server.NewTracerProvider(ctx, server.TracingConfig{Exporter: "otlp", TLS: server.TracingTLSConfig{CA: "missing.pem"}})
+	assert.Error(t, err)
+}
+
+type traceCollector struct {
+	collectortracepb.UnimplementedTraceServiceServer
+	received chan *collectortracepb.ExportTraceServiceRequest
+}
+
+func (c *traceCollector) Export(ctx context.Context, req *collectortracepb.ExportTraceServiceRequest) (*collectortracepb.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer secret" {
+		return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+	c.received <- req
+	return &collectortracepb.ExportTraceServiceResponse{}, nil
+}
+
+func TestNewTracerProvider_OTLPGRPC(t *testing.T) {
+	t.Parallel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	collector := &traceCollector{received: make(chan *collectortracepb.ExportTraceServiceRequest, 1)}
+	srv := grpc.NewServer()
+	collectortracepb.RegisterTraceServiceServer(srv, collector)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	ctx := context.Background()
+	tp, err := server.NewTracerProvider(ctx, server.TracingConfig{
+		Exporter:    "otlp",
+		Protocol:    "grpc",
+		Endpoint:    "http://" + lis.Addr().String(),
+		Headers:     map[string]string{"authorization": "Bearer secret"},
+		Compression: "gzip",
+		SampleRatio: 1,
+	})
+	require.NoError(t, err)
+
+	_, span := tp.Tracer("").Start(ctx, "IssueToken")
+	span.End()
+	require.NoError(t, tp.Shutdown(ctx))
+
+	req := <-collector.received
+	require.Len(t, req.GetResourceSpans(), 1)
+	require.Len(t, req.GetResourceSpans()[0].GetScopeSpans(), 1)
+	assert.Equal(t, "IssueToken", req.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0].GetName())
+}